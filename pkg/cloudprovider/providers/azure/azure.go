@@ -24,6 +24,13 @@ import (
 	"io/ioutil"
 	"time"
 
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 	"k8s.io/kubernetes/pkg/controller"
@@ -39,20 +46,50 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	"golang.org/x/crypto/pkcs12"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
 	// CloudProviderName is the value used for the --cloud-provider flag
-	CloudProviderName      = "azure"
-	rateLimitQPSDefault    = 1.0
-	rateLimitBucketDefault = 5
-	backoffRetriesDefault  = 6
-	backoffExponentDefault = 1.5
-	backoffDurationDefault = 5 // in seconds
-	backoffJitterDefault   = 1.0
+	CloudProviderName              = "azure"
+	rateLimitQPSDefault            = 1.0
+	rateLimitBucketDefault         = 5
+	backoffRetriesDefault          = 6
+	backoffExponentDefault         = 1.5
+	backoffDurationDefault         = 5 // in seconds
+	backoffJitterDefault           = 1.0
+	vmCacheTTLDefaultInSeconds     = 60
+	vmCacheMaxEntries              = 4096
+	nicUpdateMaxConcurrencyDefault = 10
+	// nsgCacheTTLInSeconds is intentionally short and not operator-configurable: unlike vmCache,
+	// correctness here depends on InvalidateCachedSecurityGroup firing on every write, not on the
+	// TTL. The TTL only exists as a backstop against a write being reconciled from outside this
+	// process (e.g. hand-edited in the portal) going unnoticed for longer than necessary.
+	nsgCacheTTLInSeconds = 5
+	nsgCacheMaxEntries   = 8
 )
 
+// Known SDK limitations: the fields/annotations below are accepted as configuration so a
+// misconfigured cluster gets a clear, actionable error instead of either a parse failure or
+// (worse) silent acceptance of something this build can't actually do - but each is rejected
+// outright rather than implemented, because the vendored github.com/Azure/azure-sdk-for-go in
+// this tree lacks the types the real implementation would need. This is a deliberate, tracked
+// decision, not a partial implementation:
+//   - LoadBalancerSku = "standard" (loadBalancerSkuName): network.LoadBalancer and
+//     network.PublicIPAddress have no Sku field.
+//   - EnableNatGatewayEgress (ensureSubnetNatGatewayEgress): this SDK predates NAT gateway
+//     entirely - no network.Subnet.NatGateway field, no NAT gateway client type.
+//   - ServiceAnnotationLoadBalancerDisableOutboundSNAT / -EnableOutboundSNAT: both only have an
+//     effect on a Standard SKU load balancer, which is itself unsupported per above.
+//   - LoadBalancerBackendPoolConfigurationType = "nodeVM" (backendPoolEnrollmentStrategy):
+//     network.BackendAddressPoolPropertiesFormat only models pool membership through
+//     BackendIPConfigurations, not a VM reference.
+//
+// Vendoring a newer azure-sdk-for-go would add the missing types for some of these (NAT gateway,
+// the Sku fields) and is the real fix; until then, treat every error message referencing this
+// comment as the full scope of the limitation, not as feature-complete support.
+
 // Config holds the configuration parsed from the --cloud-config flag
 // All fields are required unless otherwise specified
 type Config struct {
@@ -70,6 +107,10 @@ type Config struct {
 	VnetName string `json:"vnetName" yaml:"vnetName"`
 	// The name of the resource group that the Vnet is deployed in
 	VnetResourceGroup string `json:"vnetResourceGroup" yaml:"vnetResourceGroup"`
+	// (Optional) The default resource group that provider-created public IPs are deployed in,
+	// when a service doesn't set ServiceAnnotationLoadBalancerPIPResourceGroup itself. Falls
+	// back to ResourceGroup when unset.
+	PipResourceGroup string `json:"pipResourceGroup" yaml:"pipResourceGroup"`
 	// The name of the subnet that the cluster is deployed in
 	SubnetName string `json:"subnetName" yaml:"subnetName"`
 	// The name of the security group attached to the cluster's subnet
@@ -107,31 +148,155 @@ type Config struct {
 	CloudProviderRateLimitQPS float32 `json:"cloudProviderRateLimitQPS" yaml:"cloudProviderRateLimitQPS"`
 	// Rate limit Bucket Size
 	CloudProviderRateLimitBucket int `json:"cloudProviderRateLimitBucket" yaml:"cloudProviderRateLimitBucket"`
+	// (Optional) Rate limit QPS for write operations (CreateOrUpdate/Delete), which Azure
+	// typically quotas far more tightly than reads. Defaults to CloudProviderRateLimitQPS if
+	// unset, preserving the pre-existing single-bucket behavior.
+	CloudProviderRateLimitQPSWrite float32 `json:"cloudProviderRateLimitQPSWrite" yaml:"cloudProviderRateLimitQPSWrite"`
+	// (Optional) Rate limit bucket size for write operations. Defaults to
+	// CloudProviderRateLimitBucket if unset.
+	CloudProviderRateLimitBucketWrite int `json:"cloudProviderRateLimitBucketWrite" yaml:"cloudProviderRateLimitBucketWrite"`
 
 	// Use instance metadata service where possible
 	UseInstanceMetadata bool `json:"useInstanceMetadata" yaml:"useInstanceMetadata"`
 
 	// Use managed service identity for the virtual machine to access Azure ARM APIs
 	UseManagedIdentityExtension bool `json:"useManagedIdentityExtension"`
+
+	// (Optional) The client ID of a specific user-assigned managed identity to use, instead of
+	// the VM's system-assigned identity. Only honoured when UseManagedIdentityExtension is true.
+	UserAssignedIdentityID string `json:"userAssignedIdentityID" yaml:"userAssignedIdentityID"`
+
+	// (Optional) The interval, in seconds, used for load balancer health probes created by
+	// the provider. Defaults to 5 if unset.
+	LoadBalancerProbeIntervalInSeconds int32 `json:"loadBalancerProbeIntervalInSeconds" yaml:"loadBalancerProbeIntervalInSeconds"`
+	// (Optional) The number of consecutive failed probes before a load balancer backend
+	// instance is considered unhealthy. Defaults to 2 if unset.
+	LoadBalancerProbeNumberOfProbes int32 `json:"loadBalancerProbeNumberOfProbes" yaml:"loadBalancerProbeNumberOfProbes"`
+
+	// (Optional) When true, the provider will not create, update, or delete an LB, NSG, or
+	// PIP that's tagged with a different cluster's name, and will also leave alone any
+	// untagged resource unless AdoptUntaggedAzureResources is also set. This guards against
+	// two clusters sharing a subscription fighting over identically-named resources.
+	// Defaults to false, which preserves this provider's pre-existing behavior of modifying
+	// any resource it finds regardless of tags.
+	EnableClusterOwnershipTagCheck bool `json:"enableClusterOwnershipTagCheck" yaml:"enableClusterOwnershipTagCheck"`
+	// (Optional) When EnableClusterOwnershipTagCheck is set, also claim (by tagging) and
+	// modify resources that aren't tagged for any cluster, instead of leaving them alone.
+	// Has no effect unless EnableClusterOwnershipTagCheck is set. Defaults to false.
+	AdoptUntaggedAzureResources bool `json:"adoptUntaggedAzureResources" yaml:"adoptUntaggedAzureResources"`
+
+	// (Optional) The strategy used to enroll a node into the load balancer backend pool:
+	// "nodeIPConfiguration" (default) attaches the node's primary NIC IP configuration.
+	// "nodeVM" is not supported by this vendored Azure SDK, which only models backend pool
+	// membership through NIC IP configurations; it is accepted here only so misconfiguration
+	// is reported clearly rather than silently falling back to the default.
+	LoadBalancerBackendPoolConfigurationType string `json:"loadBalancerBackendPoolConfigurationType" yaml:"loadBalancerBackendPoolConfigurationType"`
+
+	// (Optional) The policy applied when a service's load balancing rule would occupy the
+	// same frontend IP configuration and port as another service's existing rule on a
+	// shared LB frontend (e.g. two services pinned to the same loadBalancerIP). "Error"
+	// (default) rejects the conflicting service's reconcile with a clear error instead of
+	// letting the eventual Azure API call fail. "Reassign" instead moves the conflicting
+	// service onto its own, cluster-managed frontend.
+	LoadBalancerFrontendPortConflictPolicy string `json:"loadBalancerFrontendPortConflictPolicy" yaml:"loadBalancerFrontendPortConflictPolicy"`
+
+	// (Optional) The SKU of load balancers and public IPs this provider creates. Supported
+	// values are "basic" (default) and "standard". Note: this provider build cannot actually
+	// create Standard SKU resources (see loadBalancerSkuName), so setting this to "standard"
+	// currently fails reconciliation with a clear error rather than creating one.
+	LoadBalancerSku string `json:"loadBalancerSku" yaml:"loadBalancerSku"`
+
+	// (Optional) Whether control-plane nodes (labeled labelNodeRoleMaster) are kept out of a
+	// Standard SKU load balancer's backend pool. Standard LB, unlike Basic, can front a cluster's
+	// masters as well as its agents, so this only has an effect when LoadBalancerSku is
+	// "standard"; Basic LB backend pool membership is unaffected. Note: as with LoadBalancerSku
+	// itself, this provider build cannot actually reconcile a Standard SKU load balancer (see
+	// loadBalancerSkuName), so this field currently has no reachable effect either.
+	ExcludeMasterFromStandardLB bool `json:"excludeMasterFromStandardLB" yaml:"excludeMasterFromStandardLB"`
+
+	// (Optional) Whether to associate node subnets with a NAT gateway for deterministic egress
+	// IPs, instead of relying on LB outbound SNAT. Rejected outright (see
+	// ensureSubnetNatGatewayEgress) rather than silently ignored: the vendored Azure SDK here
+	// predates NAT gateway entirely - network.Subnet has no NatGateway field, and there's no
+	// NAT gateway client type at all - and this provider never calls
+	// SubnetsClient.CreateOrUpdate, since subnets are treated as externally managed and are
+	// only ever read, never written.
+	EnableNatGatewayEgress bool `json:"enableNatGatewayEgress" yaml:"enableNatGatewayEgress"`
+
+	// (Optional) The maximum number of security rules the provider will write to a single
+	// network security group. Azure itself caps this (1000 by default), but that cap can be
+	// lowered by subscription policy, and hitting it mid-write fails opaquely. Defaults to
+	// 1000 if unset.
+	SecurityRuleMaximum int `json:"securityRuleMaximum" yaml:"securityRuleMaximum"`
+
+	// (Optional) Extra tags applied, alongside clusterOwnershipTagKey, to every LB, NSG, and PIP
+	// this provider creates or adopts. Lets an operator tell apart Kubernetes-managed resources
+	// from hand-created ones, and attach whatever else their own tagging conventions require
+	// (cost center, owner, etc). clusterOwnershipTagKey always wins if a key collides with it.
+	Tags map[string]string `json:"tags" yaml:"tags"`
+
+	// (Optional) How long, in seconds, a VirtualMachinesClient.Get result is cached before a
+	// subsequent lookup of the same VM is allowed to hit the API again. The node controller
+	// looks up every node's VM on each sync loop, and this avoids burning ARM read quota on
+	// repeated, mostly-unchanging reads. The cache is invalidated for a VM as soon as this
+	// provider updates it. Defaults to 60 if unset.
+	VMCacheTTLInSeconds int `json:"vmCacheTTLInSeconds" yaml:"vmCacheTTLInSeconds"`
+
+	// (Optional) The maximum number of InterfacesClient.CreateOrUpdate calls that
+	// reconcileLoadBalancer's backend-pool membership update is allowed to have in flight at
+	// once. A large node pool scaling up would otherwise fire one goroutine per node with no
+	// bound, which can exhaust ARM write quota just from a single reconcile. Defaults to 10 if
+	// unset.
+	NicUpdateMaxConcurrency int `json:"nicUpdateMaxConcurrency" yaml:"nicUpdateMaxConcurrency"`
 }
 
 // Cloud holds the config and clients
 type Cloud struct {
 	Config
-	Environment              azure.Environment
-	RoutesClient             network.RoutesClient
-	SubnetsClient            network.SubnetsClient
-	InterfacesClient         network.InterfacesClient
-	RouteTablesClient        network.RouteTablesClient
-	LoadBalancerClient       network.LoadBalancersClient
-	PublicIPAddressesClient  network.PublicIPAddressesClient
-	SecurityGroupsClient     network.SecurityGroupsClient
-	VirtualMachinesClient    compute.VirtualMachinesClient
-	StorageAccountClient     storage.AccountsClient
-	DisksClient              disk.DisksClient
+	Environment             azure.Environment
+	RoutesClient            network.RoutesClient
+	SubnetsClient           network.SubnetsClient
+	InterfacesClient        network.InterfacesClient
+	RouteTablesClient       network.RouteTablesClient
+	LoadBalancerClient      network.LoadBalancersClient
+	PublicIPAddressesClient network.PublicIPAddressesClient
+	SecurityGroupsClient    network.SecurityGroupsClient
+	VirtualMachinesClient   compute.VirtualMachinesClient
+	StorageAccountClient    storage.AccountsClient
+	DisksClient             disk.DisksClient
+	// operationPollRateLimiter throttles read operations (Get/List): LB, PIP, NSG, subnet, and
+	// VM client wrapper lookups.
 	operationPollRateLimiter flowcontrol.RateLimiter
-	resourceRequestBackoff   wait.Backoff
-	metadata                 *InstanceMetadata
+	// operationPollRateLimiterWrite throttles write operations (CreateOrUpdate/Delete), which
+	// Azure typically quotas far more tightly than reads.
+	operationPollRateLimiterWrite flowcontrol.RateLimiter
+	resourceRequestBackoff        wait.Backoff
+	metadata                      *InstanceMetadata
+	eventBroadcaster              record.EventBroadcaster
+	eventRecorder                 record.EventRecorder
+
+	// clock is used for Retry-After/backoff timing in processRetryResponse, so tests can inject
+	// a fake clock and assert exact retry timing instead of depending on real wall-clock sleeps.
+	// Always realClock{} outside of tests.
+	clock clock
+
+	// vmCache caches VirtualMachinesClient.Get results, keyed by vmCacheKey(resourceGroup,
+	// vmName), for VMCacheTTLInSeconds. LRUExpireCache is safe for concurrent access.
+	vmCache *utilcache.LRUExpireCache
+
+	// nsgCache caches SecurityGroupsClient.Get results, keyed by nsgCacheKey(resourceGroup,
+	// nsgName), for nsgCacheTTLInSeconds, so a burst of service reconciles in quick succession
+	// shares one read instead of each re-fetching the same NSG. Busted immediately by
+	// InvalidateCachedSecurityGroup on every successful CreateOrUpdate. LRUExpireCache is safe
+	// for concurrent access.
+	nsgCache *utilcache.LRUExpireCache
+
+	// nodeLister backs ReconcileBackendPoolMembership's view of current cluster nodes. It's
+	// wired up in Initialize from an informer this provider runs itself, rather than reusing
+	// whatever node slice a caller (e.g. the service controller) happens to pass in, so
+	// backend pool membership can be refreshed independently of that caller's own resync
+	// cadence. Nil until Initialize runs.
+	nodeLister corelisters.NodeLister
 
 	*BlobDiskController
 	*ManagedDiskController
@@ -165,21 +330,28 @@ func GetServicePrincipalToken(config *Config, env *azure.Environment) (*adal.Ser
 	}
 
 	if config.UseManagedIdentityExtension {
+		if config.UserAssignedIdentityID != "" {
+			glog.V(2).Infoln("azure: using user-assigned managed identity to retrieve access token")
+			token, err := NewInstanceMetadata().ServicePrincipalTokenFromIMDS(env.ServiceManagementEndpoint, config.UserAssignedIdentityID)
+			if err != nil {
+				return nil, fmt.Errorf("retrieving a token for user-assigned identity %s from instance metadata: %v", config.UserAssignedIdentityID, err)
+			}
+			return adal.NewServicePrincipalTokenFromManualToken(
+				*oauthConfig,
+				config.AADClientID,
+				env.ServiceManagementEndpoint,
+				*token)
+		}
+
 		glog.V(2).Infoln("azure: using managed identity extension to retrieve access token")
 		return adal.NewServicePrincipalTokenFromMSI(
 			*oauthConfig,
 			env.ServiceManagementEndpoint)
 	}
 
-	if len(config.AADClientSecret) > 0 {
-		glog.V(2).Infoln("azure: using client_id+client_secret to retrieve access token")
-		return adal.NewServicePrincipalToken(
-			*oauthConfig,
-			config.AADClientID,
-			config.AADClientSecret,
-			env.ServiceManagementEndpoint)
-	}
-
+	// Checked ahead of AADClientSecret: a config carrying both a cert and a secret (e.g. a
+	// secret left behind from before the cluster was switched to certificate auth) should use
+	// the cert, not silently keep using the older, presumably-being-rotated-out secret.
 	if len(config.AADClientCertPath) > 0 && len(config.AADClientCertPassword) > 0 {
 		glog.V(2).Infoln("azure: using jwt client_assertion (client_cert+client_private_key) to retrieve access token")
 		certData, err := ioutil.ReadFile(config.AADClientCertPath)
@@ -198,15 +370,48 @@ func GetServicePrincipalToken(config *Config, env *azure.Environment) (*adal.Ser
 			env.ServiceManagementEndpoint)
 	}
 
+	if len(config.AADClientSecret) > 0 {
+		glog.V(2).Infoln("azure: using client_id+client_secret to retrieve access token")
+		return adal.NewServicePrincipalToken(
+			*oauthConfig,
+			config.AADClientID,
+			config.AADClientSecret,
+			env.ServiceManagementEndpoint)
+	}
+
 	return nil, fmt.Errorf("No credentials provided for AAD application %s", config.AADClientID)
 }
 
+// validateConfigRequiredFields fails NewCloud fast on a config missing a field the provider
+// can't safely proceed without, instead of deferring to a confusing ARM 401/404 once it's
+// already running. UseInstanceMetadata only changes how a running provider looks up instance
+// state (see azure_instances.go); it has no bearing on the identity/location fields a config
+// needs to build clients in the first place, so it doesn't exempt any of them.
+func validateConfigRequiredFields(config *Config) error {
+	if config.SubscriptionID == "" {
+		return fmt.Errorf("SubscriptionID is required")
+	}
+	if config.TenantID == "" {
+		return fmt.Errorf("TenantID is required")
+	}
+	if config.ResourceGroup == "" {
+		return fmt.Errorf("ResourceGroup is required")
+	}
+	if config.Location == "" {
+		return fmt.Errorf("Location is required")
+	}
+	return nil
+}
+
 // NewCloud returns a Cloud with initialized clients
 func NewCloud(configReader io.Reader) (cloudprovider.Interface, error) {
 	config, env, err := ParseConfig(configReader)
 	if err != nil {
 		return nil, err
 	}
+	if err := validateConfigRequiredFields(config); err != nil {
+		return nil, err
+	}
 	az := Cloud{
 		Config:      *config,
 		Environment: *env,
@@ -282,15 +487,29 @@ func NewCloud(configReader io.Reader) (cloudprovider.Interface, error) {
 		if az.CloudProviderRateLimitBucket == 0 {
 			az.CloudProviderRateLimitBucket = rateLimitBucketDefault
 		}
+		// Writes default to the read values, preserving the pre-existing single-bucket
+		// behavior for configs that don't set them explicitly.
+		if az.CloudProviderRateLimitQPSWrite == 0 {
+			az.CloudProviderRateLimitQPSWrite = az.CloudProviderRateLimitQPS
+		}
+		if az.CloudProviderRateLimitBucketWrite == 0 {
+			az.CloudProviderRateLimitBucketWrite = az.CloudProviderRateLimitBucket
+		}
 		az.operationPollRateLimiter = flowcontrol.NewTokenBucketRateLimiter(
 			az.CloudProviderRateLimitQPS,
 			az.CloudProviderRateLimitBucket)
-		glog.V(2).Infof("Azure cloudprovider using rate limit config: QPS=%g, bucket=%d",
+		az.operationPollRateLimiterWrite = flowcontrol.NewTokenBucketRateLimiter(
+			az.CloudProviderRateLimitQPSWrite,
+			az.CloudProviderRateLimitBucketWrite)
+		glog.V(2).Infof("Azure cloudprovider using rate limit config: QPS=%g, bucket=%d, writeQPS=%g, writeBucket=%d",
 			az.CloudProviderRateLimitQPS,
-			az.CloudProviderRateLimitBucket)
+			az.CloudProviderRateLimitBucket,
+			az.CloudProviderRateLimitQPSWrite,
+			az.CloudProviderRateLimitBucketWrite)
 	} else {
 		// if rate limits are configured off, az.operationPollRateLimiter.Accept() is a no-op
 		az.operationPollRateLimiter = flowcontrol.NewFakeAlwaysRateLimiter()
+		az.operationPollRateLimiterWrite = flowcontrol.NewFakeAlwaysRateLimiter()
 	}
 
 	// Conditionally configure resource request backoff
@@ -322,6 +541,17 @@ func NewCloud(configReader io.Reader) (cloudprovider.Interface, error) {
 	}
 
 	az.metadata = NewInstanceMetadata()
+	az.clock = realClock{}
+
+	if az.VMCacheTTLInSeconds == 0 {
+		az.VMCacheTTLInSeconds = vmCacheTTLDefaultInSeconds
+	}
+	az.vmCache = utilcache.NewLRUExpireCache(vmCacheMaxEntries)
+	az.nsgCache = utilcache.NewLRUExpireCache(nsgCacheMaxEntries)
+
+	if az.NicUpdateMaxConcurrency == 0 {
+		az.NicUpdateMaxConcurrency = nicUpdateMaxConcurrencyDefault
+	}
 
 	if err := initDiskControllers(&az); err != nil {
 		return nil, err
@@ -359,7 +589,25 @@ func ParseConfig(configReader io.Reader) (*Config, *azure.Environment, error) {
 }
 
 // Initialize passes a Kubernetes clientBuilder interface to the cloud provider
-func (az *Cloud) Initialize(clientBuilder controller.ControllerClientBuilder) {}
+func (az *Cloud) Initialize(clientBuilder controller.ControllerClientBuilder) {
+	client := clientBuilder.ClientOrDie("azure-cloud-provider")
+	az.eventBroadcaster = record.NewBroadcaster()
+	az.eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(client.CoreV1().RESTClient()).Events("")})
+	az.eventRecorder = az.eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "azure-cloud-provider"})
+
+	// Run our own node informer so ReconcileBackendPoolMembership can reflect the cluster's
+	// current nodes instead of whatever slice a caller passed in, which may have been
+	// computed well before the resulting LB write actually lands.
+	nodeIndexer, nodeController := cache.NewIndexerInformer(
+		cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "nodes", "", fields.Everything()),
+		&v1.Node{},
+		0,
+		cache.ResourceEventHandlerFuncs{},
+		cache.Indexers{},
+	)
+	az.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+	go nodeController.Run(wait.NeverStop)
+}
 
 // LoadBalancer returns a balancer interface. Also returns true if the interface is supported, false otherwise.
 func (az *Cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
@@ -426,6 +674,7 @@ func initDiskControllers(az *Cloud) error {
 		tokenEndPoint:         az.Environment.ActiveDirectoryEndpoint,
 		subscriptionID:        az.SubscriptionID,
 		cloud:                 az,
+		diskOpLockMap:         newLockMap(),
 	}
 
 	// BlobDiskController: contains the function needed to
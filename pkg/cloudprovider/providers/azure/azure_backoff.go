@@ -17,11 +17,17 @@ limitations under the License.
 package azure
 
 import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -34,6 +40,10 @@ func (az *Cloud) GetVirtualMachineWithRetry(name types.NodeName) (compute.Virtua
 		var retryErr error
 		machine, exists, retryErr = az.getVirtualMachine(name)
 		if retryErr != nil {
+			if isTerminalError(autorest.Response{}, retryErr) {
+				glog.Errorf("backoff: failure, abort, err=%v", retryErr)
+				return false, retryErr
+			}
 			glog.Errorf("backoff: failure, will retry,err=%v", retryErr)
 			return false, nil
 		}
@@ -50,6 +60,10 @@ func (az *Cloud) VirtualMachineClientGetWithRetry(resourceGroup, vmName string,
 		var retryErr error
 		machine, retryErr = az.VirtualMachinesClient.Get(resourceGroup, vmName, types)
 		if retryErr != nil {
+			if isTerminalError(autorest.Response{}, retryErr) {
+				glog.Errorf("backoff: failure, abort, err=%v", retryErr)
+				return false, retryErr
+			}
 			glog.Errorf("backoff: failure, will retry,err=%v", retryErr)
 			return false, nil
 		}
@@ -66,6 +80,10 @@ func (az *Cloud) GetIPForMachineWithRetry(name types.NodeName) (string, error) {
 		var retryErr error
 		ip, retryErr = az.getIPForMachine(name)
 		if retryErr != nil {
+			if isTerminalError(autorest.Response{}, retryErr) {
+				glog.Errorf("backoff: failure, abort, err=%v", retryErr)
+				return false, retryErr
+			}
 			glog.Errorf("backoff: failure, will retry,err=%v", retryErr)
 			return false, nil
 		}
@@ -78,150 +96,183 @@ func (az *Cloud) GetIPForMachineWithRetry(name types.NodeName) (string, error) {
 // CreateOrUpdateSGWithRetry invokes az.SecurityGroupsClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateSGWithRetry(sg network.SecurityGroup) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("SecurityGroupsClient.CreateOrUpdate(%s): start", *sg.Name)
 		respChan, errChan := az.SecurityGroupsClient.CreateOrUpdate(az.ResourceGroup, *sg.Name, sg, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("SecurityGroupsClient.CreateOrUpdate(%s): end", *sg.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // CreateOrUpdateLBWithRetry invokes az.LoadBalancerClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateLBWithRetry(lb network.LoadBalancer) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("LoadBalancerClient.CreateOrUpdate(%s): start", *lb.Name)
 		respChan, errChan := az.LoadBalancerClient.CreateOrUpdate(az.ResourceGroup, *lb.Name, lb, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("LoadBalancerClient.CreateOrUpdate(%s): end", *lb.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // CreateOrUpdatePIPWithRetry invokes az.PublicIPAddressesClient.CreateOrUpdate with exponential backoff retry
-func (az *Cloud) CreateOrUpdatePIPWithRetry(pip network.PublicIPAddress) error {
+func (az *Cloud) CreateOrUpdatePIPWithRetry(pipResourceGroup string, pip network.PublicIPAddress) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("PublicIPAddressesClient.CreateOrUpdate(%s): start", *pip.Name)
-		respChan, errChan := az.PublicIPAddressesClient.CreateOrUpdate(az.ResourceGroup, *pip.Name, pip, nil)
+		respChan, errChan := az.PublicIPAddressesClient.CreateOrUpdate(pipResourceGroup, *pip.Name, pip, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("PublicIPAddressesClient.CreateOrUpdate(%s): end", *pip.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // CreateOrUpdateInterfaceWithRetry invokes az.PublicIPAddressesClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateInterfaceWithRetry(nic network.Interface) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("InterfacesClient.CreateOrUpdate(%s): start", *nic.Name)
 		respChan, errChan := az.InterfacesClient.CreateOrUpdate(az.ResourceGroup, *nic.Name, nic, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("InterfacesClient.CreateOrUpdate(%s): end", *nic.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // DeletePublicIPWithRetry invokes az.PublicIPAddressesClient.Delete with exponential backoff retry
-func (az *Cloud) DeletePublicIPWithRetry(pipName string) error {
+func (az *Cloud) DeletePublicIPWithRetry(pipResourceGroup string, pipName string) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("PublicIPAddressesClient.Delete(%s): start", pipName)
-		respChan, errChan := az.PublicIPAddressesClient.Delete(az.ResourceGroup, pipName, nil)
+		respChan, errChan := az.PublicIPAddressesClient.Delete(pipResourceGroup, pipName, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("PublicIPAddressesClient.Delete(%s): end", pipName)
-		return processRetryResponse(resp, err)
+		return az.processRetryResponse(resp, err)
 	})
 }
 
 // DeleteLBWithRetry invokes az.LoadBalancerClient.Delete with exponential backoff retry
 func (az *Cloud) DeleteLBWithRetry(lbName string) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("LoadBalancerClient.Delete(%s): start", lbName)
 		respChan, errChan := az.LoadBalancerClient.Delete(az.ResourceGroup, lbName, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("LoadBalancerClient.Delete(%s): end", lbName)
-		return processRetryResponse(resp, err)
+		return az.processRetryResponse(resp, err)
 	})
 }
 
 // CreateOrUpdateRouteTableWithRetry invokes az.RouteTablesClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateRouteTableWithRetry(routeTable network.RouteTable) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("RouteTablesClient.CreateOrUpdate(%s): start", *routeTable.Name)
-		respChan, errChan := az.RouteTablesClient.CreateOrUpdate(az.ResourceGroup, az.RouteTableName, routeTable, nil)
+		respChan, errChan := az.RouteTablesClient.CreateOrUpdate(az.routeTableResourceGroup(), az.RouteTableName, routeTable, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("RouteTablesClient.CreateOrUpdate(%s): end", *routeTable.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // CreateOrUpdateRouteWithRetry invokes az.RoutesClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateRouteWithRetry(route network.Route) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("RoutesClient.CreateOrUpdate(%s): start", *route.Name)
-		respChan, errChan := az.RoutesClient.CreateOrUpdate(az.ResourceGroup, az.RouteTableName, *route.Name, route, nil)
+		respChan, errChan := az.RoutesClient.CreateOrUpdate(az.routeTableResourceGroup(), az.RouteTableName, *route.Name, route, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("RoutesClient.CreateOrUpdate(%s): end", *route.Name)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
 // DeleteRouteWithRetry invokes az.RoutesClient.Delete with exponential backoff retry
 func (az *Cloud) DeleteRouteWithRetry(routeName string) error {
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("RoutesClient.Delete(%s): start", az.RouteTableName)
-		respChan, errChan := az.RoutesClient.Delete(az.ResourceGroup, az.RouteTableName, routeName, nil)
+		respChan, errChan := az.RoutesClient.Delete(az.routeTableResourceGroup(), az.RouteTableName, routeName, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("RoutesClient.Delete(%s): end", az.RouteTableName)
-		return processRetryResponse(resp, err)
+		return az.processRetryResponse(resp, err)
 	})
 }
 
 // CreateOrUpdateVMWithRetry invokes az.VirtualMachinesClient.CreateOrUpdate with exponential backoff retry
 func (az *Cloud) CreateOrUpdateVMWithRetry(vmName string, newVM compute.VirtualMachine) error {
+	defer az.InvalidateCachedVirtualMachine(types.NodeName(vmName))
 	return wait.ExponentialBackoff(az.resourceRequestBackoff, func() (bool, error) {
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("VirtualMachinesClient.CreateOrUpdate(%s): start", vmName)
 		respChan, errChan := az.VirtualMachinesClient.CreateOrUpdate(az.ResourceGroup, vmName, newVM, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("VirtualMachinesClient.CreateOrUpdate(%s): end", vmName)
-		return processRetryResponse(resp.Response, err)
+		return az.processRetryResponse(resp.Response, err)
 	})
 }
 
+// clock abstracts the wall-clock dependencies of processRetryResponse's Retry-After handling, so
+// tests can inject a fake clock and assert exact retry timing instead of sleeping in real time.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the production clock implementation, used by every Cloud outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
 // A wait.ConditionFunc function to deal with common HTTP backoff response conditions
-func processRetryResponse(resp autorest.Response, err error) (bool, error) {
+func (az *Cloud) processRetryResponse(resp autorest.Response, err error) (bool, error) {
 	if isSuccessHTTPResponse(resp) {
 		glog.V(2).Infof("backoff: success, HTTP response=%d", resp.StatusCode)
 		return true, nil
 	}
+	if isThrottled(resp) {
+		// Azure throttles ARM requests independently of the terminal/retryable status code
+		// classification below, and tells us exactly how long to back off via Retry-After.
+		// Honor it directly instead of leaving the wait to backoff's own exponent/jitter, which
+		// has no idea how aggressively Azure is throttling this particular request.
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), az.clock.Now()); ok {
+			glog.Errorf("backoff: throttled (429), waiting %v per Retry-After before retrying", retryAfter)
+			az.clock.Sleep(retryAfter)
+		} else {
+			glog.Errorf("backoff: throttled (429), no usable Retry-After header, falling back to configured backoff")
+		}
+		return false, nil
+	}
 	if shouldRetryAPIRequest(resp, err) {
 		glog.Errorf("backoff: failure, will retry, HTTP response=%d, err=%v", resp.StatusCode, err)
 		// suppress the error object so that backoff process continues
 		return false, nil
 	}
 	// Fall-through: stop periodic backoff, return error object from most recent request
+	if err == nil {
+		err = fmt.Errorf("backoff: terminal HTTP response=%d", resp.StatusCode)
+	}
 	return true, err
 }
 
 // shouldRetryAPIRequest determines if the response from an HTTP request suggests periodic retry behavior
 func shouldRetryAPIRequest(resp autorest.Response, err error) bool {
+	if isTerminalError(resp, err) {
+		return false
+	}
 	if err != nil {
 		return true
 	}
@@ -232,6 +283,36 @@ func shouldRetryAPIRequest(resp autorest.Response, err error) bool {
 	return false
 }
 
+// terminalHTTPStatusCodes are HTTP status codes that indicate a request is wrong in a way that
+// retrying it unmodified will not fix, so backoff should fail fast instead of spending its
+// retry budget on a request that cannot succeed.
+var terminalHTTPStatusCodes = map[int]bool{
+	http.StatusBadRequest:   true,
+	http.StatusUnauthorized: true,
+	http.StatusForbidden:    true,
+	http.StatusNotFound:     true,
+}
+
+// terminalAzureErrorCodes are Azure service error codes (the "code" field of the error response
+// body) that are terminal regardless of which HTTP status they happen to arrive with.
+var terminalAzureErrorCodes = map[string]bool{
+	"AuthorizationFailed":   true,
+	"InvalidParameter":      true,
+	"InvalidParameterValue": true,
+	"QuotaExceeded":         true,
+}
+
+// isTerminalError classifies a failed request as terminal (not worth retrying) based on its
+// HTTP status code and, when the error is an Azure service error, its error code.
+func isTerminalError(resp autorest.Response, err error) bool {
+	if requestErr, ok := err.(*azure.RequestError); ok && requestErr.ServiceError != nil {
+		if terminalAzureErrorCodes[requestErr.ServiceError.Code] {
+			return true
+		}
+	}
+	return terminalHTTPStatusCodes[resp.StatusCode]
+}
+
 // isSuccessHTTPResponse determines if the response from an HTTP request suggests success
 func isSuccessHTTPResponse(resp autorest.Response) bool {
 	// HTTP 2xx suggests a successful response
@@ -240,3 +321,31 @@ func isSuccessHTTPResponse(resp autorest.Response) bool {
 	}
 	return false
 }
+
+// isThrottled reports whether resp is an HTTP 429 Too Many Requests response, Azure's signal
+// that this particular request (not just the account generally) is being rate limited.
+func isThrottled(resp autorest.Response) bool {
+	return resp.Response != nil && resp.StatusCode == http.StatusTooManyRequests
+}
+
+// parseRetryAfter parses an HTTP Retry-After header value into a wait duration relative to now.
+// Azure sends this either as a number of seconds or as an HTTP-date; it returns false if header
+// is empty or doesn't parse as either form, or parses to a non-positive number of seconds.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if d := when.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
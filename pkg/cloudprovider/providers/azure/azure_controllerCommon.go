@@ -19,6 +19,7 @@ package azure
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/types"
@@ -66,11 +67,49 @@ type controllerCommon struct {
 	aadToken              string
 	expiresOn             time.Time
 	cloud                 *Cloud
+	// diskOpLockMap serializes AttachDisk/DetachDiskByName per VM, so that two concurrent disk
+	// operations against the same VM can't race on the StorageProfile.DataDisks
+	// read-modify-write cycle through VirtualMachinesClient.CreateOrUpdate.
+	diskOpLockMap *lockMap
+}
+
+// lockMap serializes operations keyed by an arbitrary string, handing out a distinct mutex per
+// key so callers using different keys never block each other.
+type lockMap struct {
+	sync.Mutex
+	mutexMap map[string]*sync.Mutex
+}
+
+func newLockMap() *lockMap {
+	return &lockMap{mutexMap: make(map[string]*sync.Mutex)}
+}
+
+// LockEntry acquires the mutex for key, creating it if key hasn't been locked before.
+func (l *lockMap) LockEntry(key string) {
+	l.getOrCreateEntry(key).Lock()
+}
+
+// UnlockEntry releases the mutex for key.
+func (l *lockMap) UnlockEntry(key string) {
+	l.getOrCreateEntry(key).Unlock()
+}
+
+func (l *lockMap) getOrCreateEntry(key string) *sync.Mutex {
+	l.Lock()
+	defer l.Unlock()
+	if _, exists := l.mutexMap[key]; !exists {
+		l.mutexMap[key] = &sync.Mutex{}
+	}
+	return l.mutexMap[key]
 }
 
 // AttachDisk attaches a vhd to vm
 // the vhd must exist, can be identified by diskName, diskURI, and lun.
 func (c *controllerCommon) AttachDisk(isManagedDisk bool, diskName, diskURI string, nodeName types.NodeName, lun int32, cachingMode compute.CachingTypes) error {
+	vmName := mapNodeNameToVMName(nodeName)
+	c.diskOpLockMap.LockEntry(vmName)
+	defer c.diskOpLockMap.UnlockEntry(vmName)
+
 	vm, exists, err := c.cloud.getVirtualMachine(nodeName)
 	if err != nil {
 		return err
@@ -110,9 +149,9 @@ func (c *controllerCommon) AttachDisk(isManagedDisk bool, diskName, diskURI stri
 			},
 		},
 	}
-	vmName := mapNodeNameToVMName(nodeName)
+	defer c.cloud.InvalidateCachedVirtualMachine(nodeName)
 	glog.V(2).Infof("azureDisk - update(%s): vm(%s) - attach disk", c.resourceGroup, vmName)
-	c.cloud.operationPollRateLimiter.Accept()
+	c.cloud.operationPollRateLimiterWrite.Accept()
 	respChan, errChan := c.cloud.VirtualMachinesClient.CreateOrUpdate(c.resourceGroup, vmName, newVM, nil)
 	resp := <-respChan
 	err = <-errChan
@@ -141,6 +180,10 @@ func (c *controllerCommon) AttachDisk(isManagedDisk bool, diskName, diskURI stri
 // DetachDiskByName detaches a vhd from host
 // the vhd can be identified by diskName or diskURI
 func (c *controllerCommon) DetachDiskByName(diskName, diskURI string, nodeName types.NodeName) error {
+	vmName := mapNodeNameToVMName(nodeName)
+	c.diskOpLockMap.LockEntry(vmName)
+	defer c.diskOpLockMap.UnlockEntry(vmName)
+
 	vm, exists, err := c.cloud.getVirtualMachine(nodeName)
 	if err != nil || !exists {
 		// if host doesn't exist, no need to detach
@@ -163,7 +206,9 @@ func (c *controllerCommon) DetachDiskByName(diskName, diskURI string, nodeName t
 	}
 
 	if !bFoundDisk {
-		return fmt.Errorf("detach azure disk failure, disk %s not found, diskURI: %s", diskName, diskURI)
+		// the disk is already not attached, nothing to do
+		glog.V(2).Infof("azureDisk - disk %s (uri %s) is not attached to node %s, skip detaching", diskName, diskURI, nodeName)
+		return nil
 	}
 
 	newVM := compute.VirtualMachine{
@@ -174,9 +219,9 @@ func (c *controllerCommon) DetachDiskByName(diskName, diskURI string, nodeName t
 			},
 		},
 	}
-	vmName := mapNodeNameToVMName(nodeName)
+	defer c.cloud.InvalidateCachedVirtualMachine(nodeName)
 	glog.V(2).Infof("azureDisk - update(%s): vm(%s) - detach disk", c.resourceGroup, vmName)
-	c.cloud.operationPollRateLimiter.Accept()
+	c.cloud.operationPollRateLimiterWrite.Accept()
 	respChan, errChan := c.cloud.VirtualMachinesClient.CreateOrUpdate(c.resourceGroup, vmName, newVM, nil)
 	resp := <-respChan
 	err = <-errChan
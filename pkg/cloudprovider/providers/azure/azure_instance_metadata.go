@@ -18,12 +18,44 @@ package azure
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
 )
 
 const metadataURL = "http://169.254.169.254/metadata/"
 
+// identityTokenPath is the IMDS endpoint for fetching an OAuth token for the VM's managed
+// identity. It lives on the same metadata server as the instance/attested endpoints below, but
+// is versioned and shaped differently (resource/client_id query params, no "format" parameter),
+// so it's queried directly rather than through queryMetadataBytes.
+const identityTokenPath = "identity/oauth2/token"
+
+const identityTokenAPIVersion = "2018-02-01"
+
+const defaultAPIVersion = "2017-04-02"
+
+// apiVersions maps an instance metadata endpoint (identified by the first segment of its
+// path) to the api-version it expects. IMDS versions each endpoint independently, so an
+// api-version that works for "instance" can 400 against e.g. "attested".
+var apiVersions = map[string]string{
+	"instance": defaultAPIVersion,
+	"attested": "2017-08-01",
+}
+
+// apiVersionForPath returns the api-version to send for the given metadata path, falling
+// back to defaultAPIVersion for endpoints without an explicit entry above.
+func apiVersionForPath(path string) string {
+	endpoint := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if version, ok := apiVersions[endpoint]; ok {
+		return version
+	}
+	return defaultAPIVersion
+}
+
 // NetworkMetadata contains metadata about an instance's network
 type NetworkMetadata struct {
 	Interface []NetworkInterface `json:"interface"`
@@ -54,6 +86,23 @@ type Subnet struct {
 	Prefix  string `json:"prefix"`
 }
 
+// ComputeMetadata contains metadata about an instance's compute properties. IMDS exposes many
+// more fields under instance/compute than this, but VMSize and Name are the only ones any caller
+// in this provider currently needs.
+type ComputeMetadata struct {
+	VMSize string `json:"vmSize"`
+	Name   string `json:"name"`
+}
+
+// AttestedDocument represents the signed instance metadata document returned by the
+// attested/document endpoint. Signature is a base64-encoded PKCS7 blob covering Document;
+// verifying it against the Azure certificate chain is the caller's responsibility, as this
+// provider only retrieves the document and does not attempt signature verification.
+type AttestedDocument struct {
+	Encoding  string `json:"encoding"`
+	Signature string `json:"signature"`
+}
+
 // InstanceMetadata knows how to query the Azure instance metadata server.
 type InstanceMetadata struct {
 	baseURL string
@@ -89,6 +138,68 @@ func (i *InstanceMetadata) Text(path string) (string, error) {
 	return string(data), err
 }
 
+// AttestedDocument fetches the signed instance metadata document, for callers that need
+// to verify the instance is running on genuine Azure hardware. The returned Signature is
+// not verified here.
+func (i *InstanceMetadata) AttestedDocument() (*AttestedDocument, error) {
+	doc := AttestedDocument{}
+	if err := i.Object("/attested/document", &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Compute fetches the instance's compute metadata document.
+func (i *InstanceMetadata) Compute() (*ComputeMetadata, error) {
+	compute := ComputeMetadata{}
+	if err := i.Object("instance/compute", &compute); err != nil {
+		return nil, err
+	}
+	return &compute, nil
+}
+
+// ServicePrincipalTokenFromIMDS fetches an OAuth token for the VM's managed identity directly
+// from the instance metadata service. This exists alongside adal.NewServicePrincipalTokenFromMSI
+// because the vendored adal library's MSI support predates user-assigned identities and has no
+// client_id parameter (see vendor/github.com/Azure/go-autorest/autorest/adal/token.go) - a
+// userAssignedIdentityID can only be honoured by talking to IMDS ourselves. Pass an empty
+// userAssignedIdentityID to request the VM's system-assigned identity instead.
+func (i *InstanceMetadata) ServicePrincipalTokenFromIMDS(resource, userAssignedIdentityID string) (*adal.Token, error) {
+	req, err := http.NewRequest("GET", i.makeMetadataURL(identityTokenPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata", "True")
+
+	q := req.URL.Query()
+	q.Add("api-version", identityTokenAPIVersion)
+	q.Add("resource", resource)
+	if userAssignedIdentityID != "" {
+		q.Add("client_id", userAssignedIdentityID)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata identity endpoint returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	token := &adal.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
 func (i *InstanceMetadata) queryMetadataBytes(path, format string) ([]byte, error) {
 	client := &http.Client{}
 
@@ -100,7 +211,7 @@ func (i *InstanceMetadata) queryMetadataBytes(path, format string) ([]byte, erro
 
 	q := req.URL.Query()
 	q.Add("format", format)
-	q.Add("api-version", "2017-04-02")
+	q.Add("api-version", apiVersionForPath(path))
 	req.URL.RawQuery = q.Encode()
 
 	resp, err := client.Do(req)
@@ -27,26 +27,45 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// nodeAddressesFromMetadata builds the NodeAddress list for name from an instance metadata
+// ipv4/ipAddress entry, so NodeAddresses doesn't need a VirtualMachinesClient/InterfacesClient
+// round trip just to report the local node's own addresses. hostname is the instance's
+// compute.name from metadata, falling back to the Kubernetes node name when empty (e.g. the
+// instance/compute query itself failed, which shouldn't fail NodeAddresses over a field it
+// doesn't strictly need).
+func nodeAddressesFromMetadata(name types.NodeName, ipAddress IPAddress, hostname string) []v1.NodeAddress {
+	if hostname == "" {
+		hostname = string(name)
+	}
+	addresses := []v1.NodeAddress{
+		{Type: v1.NodeInternalIP, Address: ipAddress.PrivateIP},
+		{Type: v1.NodeHostName, Address: hostname},
+	}
+	if len(ipAddress.PublicIP) > 0 {
+		addresses = append(addresses, v1.NodeAddress{
+			Type:    v1.NodeExternalIP,
+			Address: ipAddress.PublicIP,
+		})
+	}
+	return addresses
+}
+
 // NodeAddresses returns the addresses of the specified instance.
 func (az *Cloud) NodeAddresses(name types.NodeName) ([]v1.NodeAddress, error) {
 	if az.UseInstanceMetadata {
 		ipAddress := IPAddress{}
 		err := az.metadata.Object("instance/network/interface/0/ipv4/ipAddress/0", &ipAddress)
-		if err != nil {
-			return nil, err
-		}
-		addresses := []v1.NodeAddress{
-			{Type: v1.NodeInternalIP, Address: ipAddress.PrivateIP},
-			{Type: v1.NodeHostName, Address: string(name)},
-		}
-		if len(ipAddress.PublicIP) > 0 {
-			addr := v1.NodeAddress{
-				Type:    v1.NodeExternalIP,
-				Address: ipAddress.PublicIP,
+		if err == nil {
+			hostname, err := az.metadata.Text("instance/compute/name")
+			if err != nil {
+				glog.V(2).Infof("NodeAddresses(%s): failed to query instance compute name, falling back to the node name: %v", name, err)
 			}
-			addresses = append(addresses, addr)
+			return nodeAddressesFromMetadata(name, ipAddress, hostname), nil
 		}
-		return addresses, nil
+		// The metadata endpoint is only reachable from inside the instance it describes, so a
+		// transient network hiccup there shouldn't fail the whole lookup - fall back to the ARM
+		// path below instead of returning err here.
+		glog.V(2).Infof("NodeAddresses(%s): failed to query instance metadata, falling back to ARM: %v", name, err)
 	}
 	ip, err := az.getIPForMachine(name)
 	if err != nil {
@@ -163,7 +182,8 @@ func (az *Cloud) InstanceTypeByProviderID(providerID string) (string, error) {
 // InstanceType returns the type of the specified instance.
 // Note that if the instance does not exist or is no longer running, we must return ("", cloudprovider.InstanceNotFound)
 // (Implementer Note): This is used by kubelet. Kubelet will label the node. Real log from kubelet:
-//       Adding node label from cloud provider: beta.kubernetes.io/instance-type=[value]
+//
+//	Adding node label from cloud provider: beta.kubernetes.io/instance-type=[value]
 func (az *Cloud) InstanceType(name types.NodeName) (string, error) {
 	if az.UseInstanceMetadata {
 		isLocalInstance, err := az.isCurrentInstance(name)
@@ -171,9 +191,9 @@ func (az *Cloud) InstanceType(name types.NodeName) (string, error) {
 			return "", err
 		}
 		if isLocalInstance {
-			machineType, err := az.metadata.Text("instance/compute/vmSize")
-			if err == nil {
-				return machineType, nil
+			compute, err := az.metadata.Compute()
+			if err == nil && compute.VMSize != "" {
+				return compute.VMSize, nil
 			}
 		}
 	}
@@ -187,10 +207,69 @@ func (az *Cloud) InstanceType(name types.NodeName) (string, error) {
 	return string(machine.HardwareProfile.VMSize), nil
 }
 
+// sshPublicKeyPath returns the path on the VM's filesystem that an SSH public key for user should
+// be placed at, matching the layout sshd expects for AuthorizedKeysFile.
+func sshPublicKeyPath(user string) string {
+	return fmt.Sprintf("/home/%s/.ssh/authorized_keys", user)
+}
+
+// linuxConfigurationHasSSHKey reports whether linuxConfig already carries keyData at path, so
+// AddSSHKeyToAllInstances can skip VMs that already have the key instead of writing an identical
+// update to every VM on every call.
+func linuxConfigurationHasSSHKey(linuxConfig *compute.LinuxConfiguration, path, keyData string) bool {
+	if linuxConfig == nil || linuxConfig.SSH == nil || linuxConfig.SSH.PublicKeys == nil {
+		return false
+	}
+	for _, pk := range *linuxConfig.SSH.PublicKeys {
+		if pk.Path != nil && *pk.Path == path && pk.KeyData != nil && *pk.KeyData == keyData {
+			return true
+		}
+	}
+	return false
+}
+
 // AddSSHKeyToAllInstances adds an SSH public key as a legal identity for all instances
 // expected format for the key is standard ssh-keygen format: <protocol> <blob>
+//
+// It iterates every VM in az.ResourceGroup and idempotently merges the key into
+// OsProfile.LinuxConfiguration.SSH.PublicKeys, skipping VMs that already carry it and VMs with no
+// LinuxConfiguration (e.g. Windows instances, or Linux instances with password auth only and no
+// OsProfile to key off of) rather than failing the whole batch over them.
 func (az *Cloud) AddSSHKeyToAllInstances(user string, keyData []byte) error {
-	return fmt.Errorf("not supported")
+	path := sshPublicKeyPath(user)
+	key := string(keyData)
+
+	vms, err := az.listAllNodesInResourceGroup()
+	if err != nil {
+		return err
+	}
+
+	for _, vm := range vms {
+		if vm.Name == nil || vm.VirtualMachineProperties == nil || vm.OsProfile == nil || vm.OsProfile.LinuxConfiguration == nil {
+			continue
+		}
+		linuxConfig := vm.OsProfile.LinuxConfiguration
+		if linuxConfigurationHasSSHKey(linuxConfig, path, key) {
+			continue
+		}
+
+		if linuxConfig.SSH == nil {
+			linuxConfig.SSH = &compute.SSHConfiguration{}
+		}
+		newKey := compute.SSHPublicKey{Path: &path, KeyData: &key}
+		if linuxConfig.SSH.PublicKeys == nil {
+			linuxConfig.SSH.PublicKeys = &[]compute.SSHPublicKey{newKey}
+		} else {
+			updated := append(*linuxConfig.SSH.PublicKeys, newKey)
+			linuxConfig.SSH.PublicKeys = &updated
+		}
+
+		if err := az.CreateOrUpdateVMWithRetry(*vm.Name, vm); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // CurrentNodeName returns the name of the node we are currently running on
@@ -199,6 +278,15 @@ func (az *Cloud) CurrentNodeName(hostname string) (types.NodeName, error) {
 	return types.NodeName(hostname), nil
 }
 
+// vmListHasNextPage reports whether result carries a NextLink that
+// VirtualMachinesClient.ListAllNextResults should follow for a further page, rather than
+// guessing "more pages" from how many VMs the current page happened to contain - a resource
+// group with exactly one VM per page (or a final page landing on more than one) would
+// otherwise be paged incorrectly.
+func vmListHasNextPage(result compute.VirtualMachineListResult) bool {
+	return result.NextLink != nil && len(*result.NextLink) > 0
+}
+
 func (az *Cloud) listAllNodesInResourceGroup() ([]compute.VirtualMachine, error) {
 	allNodes := []compute.VirtualMachine{}
 
@@ -211,10 +299,14 @@ func (az *Cloud) listAllNodesInResourceGroup() ([]compute.VirtualMachine, error)
 		return nil, err
 	}
 
-	morePages := (result.Value != nil && len(*result.Value) > 1)
+	for {
+		if result.Value != nil {
+			allNodes = append(allNodes, *result.Value...)
+		}
 
-	for morePages {
-		allNodes = append(allNodes, *result.Value...)
+		if !vmListHasNextPage(result) {
+			break
+		}
 
 		az.operationPollRateLimiter.Accept()
 		glog.V(10).Infof("VirtualMachinesClient.ListAllNextResults(%v): start", az.ResourceGroup)
@@ -224,8 +316,6 @@ func (az *Cloud) listAllNodesInResourceGroup() ([]compute.VirtualMachine, error)
 			glog.Errorf("error: az.listAllNodesInResourceGroup(), az.VirtualMachinesClient.ListAllNextResults(%v), err=%v", result, err)
 			return nil, err
 		}
-
-		morePages = (result.Value != nil && len(*result.Value) > 1)
 	}
 
 	return allNodes, nil
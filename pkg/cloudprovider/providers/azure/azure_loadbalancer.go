@@ -18,12 +18,17 @@ package azure
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	serviceapi "k8s.io/kubernetes/pkg/api/v1/service"
+	"k8s.io/kubernetes/pkg/cloudprovider"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
@@ -32,6 +37,20 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// reconcileFailedEventReason is the reason recorded on the Service object when
+// a load balancer reconcile fails.
+const reconcileFailedEventReason = "SyncLoadBalancerFailed"
+
+// recordReconcileFailure surfaces a reconcile error as a Kubernetes event on
+// the Service object, in addition to the existing glog output. This is a
+// no-op if no EventRecorder was wired up via Initialize().
+func (az *Cloud) recordReconcileFailure(service *v1.Service, err error) {
+	if az.eventRecorder == nil || err == nil {
+		return
+	}
+	az.eventRecorder.Eventf(service, v1.EventTypeWarning, reconcileFailedEventReason, "Error reconciling load balancer: %v", err)
+}
+
 // ServiceAnnotationLoadBalancerInternal is the annotation used on the service
 const ServiceAnnotationLoadBalancerInternal = "service.beta.kubernetes.io/azure-load-balancer-internal"
 
@@ -39,11 +58,902 @@ const ServiceAnnotationLoadBalancerInternal = "service.beta.kubernetes.io/azure-
 // to specify what subnet it is exposed on
 const ServiceAnnotationLoadBalancerInternalSubnet = "service.beta.kubernetes.io/azure-load-balancer-internal-subnet"
 
+// ServiceAnnotationLoadBalancerInternalIP pins an internal service's frontend to a specific
+// private IP address, for users who need a stable address for firewall rules. Spec.LoadBalancerIP
+// takes precedence when both are set; this annotation exists for services that already use
+// Spec.LoadBalancerIP for something else (e.g. migrating from an existing, differently-addressed
+// internal LB) but still want a pinned Azure-specific address. The address must fall inside the
+// target subnet's CIDR, or reconcile fails before ever calling CreateOrUpdate.
+const ServiceAnnotationLoadBalancerInternalIP = "service.beta.kubernetes.io/azure-load-balancer-internal-ip"
+
+// ServiceAnnotationLoadBalancerInternalAllowBroadSource widens an internal service's NSG
+// allow rule from the default VirtualNetwork source tag back to a broad "Internet" source,
+// for the rare internal service that needs reachability from outside the vnet (e.g. over a
+// VPN or ExpressRoute peering Azure doesn't fold into the VirtualNetwork tag). Only consulted
+// when the service doesn't set its own LoadBalancerSourceRanges.
+const ServiceAnnotationLoadBalancerInternalAllowBroadSource = "service.beta.kubernetes.io/azure-load-balancer-internal-allow-broad-source-range"
+
+// ServiceAnnotationLoadBalancerEnableFloatingIP enables floating IP (Direct Server Return) on
+// the load balancing rule, so the backend sees the original frontend destination IP/port
+// instead of the load balancer rewriting it to the node's own address. Needed by workloads
+// (e.g. SIP) that depend on the destination address being preserved. Defaults to false; when
+// enabled, the rule's BackendPort is set to the service's FrontendPort rather than its NodePort,
+// since floating IP requires the backend to listen on the same port the frontend exposes.
+const ServiceAnnotationLoadBalancerEnableFloatingIP = "service.beta.kubernetes.io/azure-load-balancer-enable-floating-ip"
+
+// ServiceAnnotationLoadBalancerPIPResourceGroup overrides the resource group that a
+// provider-created public IP for this service lives in, letting PIPs be centralized in a
+// shared group for IP governance while the load balancer itself stays in the cluster's
+// resource group.
+const ServiceAnnotationLoadBalancerPIPResourceGroup = "service.beta.kubernetes.io/azure-load-balancer-resource-group"
+
+// ServiceAnnotationLoadBalancerPublicIPName binds a service to a pre-provisioned public IP by
+// name, instead of letting the provider allocate and own one. The named PublicIPAddress must
+// already exist; reconcile fails rather than creating a new one if it's missing, since a
+// silent fallback would give the caller an address it didn't ask to be pinned to. Service
+// teardown does not delete this PIP: cleanupLoadBalancer deletes only a PIP whose name matches
+// getPublicIPName for the service.
+const ServiceAnnotationLoadBalancerPublicIPName = "service.beta.kubernetes.io/azure-load-balancer-public-ip-name"
+
+// ServiceAnnotationLoadBalancerDNSLabel sets DNSSettings.DomainNameLabel on a service's
+// provider-created public IP, giving it a resolvable FQDN of the form
+// "<label>.<location>.cloudapp.azure.com". The resulting FQDN is surfaced onto the service's
+// LoadBalancerStatus ingress Hostname. Only takes effect when the provider creates the PIP
+// (ignored for services using ServiceAnnotationLoadBalancerPublicIPName to reuse one).
+const ServiceAnnotationLoadBalancerDNSLabel = "service.beta.kubernetes.io/azure-dns-label-name"
+
+// ServiceAnnotationPIPReverseFqdn sets DNSSettings.ReverseFqdn on a service's provider-created
+// public IP, so Azure answers PTR lookups against that IP with the given FQDN. Only takes
+// effect when the provider creates the PIP (ignored for services using a loadBalancerIP that
+// maps to an existing, user-managed PIP).
+const ServiceAnnotationPIPReverseFqdn = "service.beta.kubernetes.io/azure-pip-reverse-fqdn"
+
+// ServiceAnnotationPIPAllocationMethod selects Static or Dynamic allocation for a service's
+// provider-created public IP. Defaults to Static, preserving existing behavior. Switching an
+// existing PIP from Dynamic to Static is converted in place via CreateOrUpdate rather than a
+// delete-and-recreate, since deleting would hand back a different address.
+const ServiceAnnotationPIPAllocationMethod = "service.beta.kubernetes.io/azure-pip-allocation-method"
+
+// ServiceAnnotationLoadBalancerInternalSubnetResourceGroup overrides the cluster-wide
+// VnetResourceGroup for this internal service's subnet lookup and frontend configuration,
+// for multi-tenant clusters that place service subnets in different vnet resource groups.
+const ServiceAnnotationLoadBalancerInternalSubnetResourceGroup = "service.beta.kubernetes.io/azure-load-balancer-internal-subnet-resource-group"
+
+// ServiceAnnotationLoadBalancerInternalSubnetSubscriptionID overrides the cluster's own
+// SubscriptionID for this internal service's subnet lookup, for customers who keep their vnet in
+// a shared networking subscription entirely separate from the cluster's subscription. Only
+// meaningful alongside ServiceAnnotationLoadBalancerInternalSubnetResourceGroup, since a resource
+// group name alone is only unique within a subscription.
+const ServiceAnnotationLoadBalancerInternalSubnetSubscriptionID = "service.beta.kubernetes.io/azure-load-balancer-internal-subnet-subscription-id"
+
+// ServiceAnnotationLoadBalancerDisableOutboundSNAT requests that outbound SNAT be disabled
+// on this internal service's load balancing rules, so the client's original IP is preserved
+// within the vnet. This is only meaningful for a Standard SKU load balancer; this cloud
+// provider build only supports Basic SKU, so setting this annotation is rejected outright
+// rather than silently ignored. This is one of the tracked SDK-gap rejections listed in
+// Config's doc comment, not a partial implementation.
+const ServiceAnnotationLoadBalancerDisableOutboundSNAT = "service.beta.kubernetes.io/azure-load-balancer-disable-outbound-snat"
+
+// ServiceAnnotationLoadBalancerEnableOutboundSNAT requests an explicit outbound rule tying this
+// service's backend pool to its frontend public IP, for Standard SKU load balancers (which,
+// unlike Basic, give backends no implicit outbound connectivity at all). Like
+// ServiceAnnotationLoadBalancerDisableOutboundSNAT, this is only meaningful for a Standard SKU
+// load balancer; this cloud provider build only supports Basic SKU, where outbound connectivity
+// through the frontend is already implicit, so setting this annotation is rejected outright
+// rather than silently ignored. This is one of the tracked SDK-gap rejections listed in
+// Config's doc comment, not a partial implementation.
+const ServiceAnnotationLoadBalancerEnableOutboundSNAT = "service.beta.kubernetes.io/azure-load-balancer-enable-outbound-snat"
+
+// ServiceAnnotationLoadBalancerHealthProbeProtocol determines the network protocol that the
+// Azure health probe for a service's ports use. Supported values are Http, Https and Tcp.
+// If unset, the probe protocol defaults to whatever protocol the rule itself uses (Tcp, or
+// Http when the service requests health checks via externalTrafficPolicy: Local).
+const ServiceAnnotationLoadBalancerHealthProbeProtocol = "service.beta.kubernetes.io/azure-load-balancer-health-probe-protocol"
+
+// ServiceAnnotationLoadBalancerHealthProbeRequestPath determines the request path used by an
+// Http or Https health probe. Ignored for Tcp probes.
+const ServiceAnnotationLoadBalancerHealthProbeRequestPath = "service.beta.kubernetes.io/azure-load-balancer-health-probe-request-path"
+
+// ServiceAnnotationLoadBalancerHealthProbePort overrides the port the health probe targets,
+// decoupling it from the rule's own port. This lets, for example, a TCP rule be probed over a
+// separate HTTP admin/health port instead of the service port itself. Ignored when
+// externalTrafficPolicy: Local health checks are in effect, which always probe the fixed node
+// health check port.
+const ServiceAnnotationLoadBalancerHealthProbePort = "service.beta.kubernetes.io/azure-load-balancer-health-probe-port"
+
+// ServiceAnnotationLoadBalancerHealthProbeInterval overrides LoadBalancerProbeIntervalInSeconds
+// for this service's health probe, in seconds. Takes precedence over the cloud-config default.
+const ServiceAnnotationLoadBalancerHealthProbeInterval = "service.beta.kubernetes.io/azure-load-balancer-health-probe-interval"
+
+// ServiceAnnotationLoadBalancerHealthProbeNumOfProbe overrides LoadBalancerProbeNumberOfProbes
+// for this service's health probe - the number of consecutive failed probes before Azure marks
+// the backend instance unhealthy and stops sending it traffic. Takes precedence over the
+// cloud-config default.
+const ServiceAnnotationLoadBalancerHealthProbeNumOfProbe = "service.beta.kubernetes.io/azure-load-balancer-health-probe-num-of-probe"
+
+// ServiceAnnotationLoadBalancerAdditionalFrontend requests that this service maintain both its
+// external (Public IP) LB frontend and its internal (vnet-private) LB frontend simultaneously -
+// for split-horizon workloads where some clients reach the service over the internet and others
+// reach it from inside the vnet - instead of only the one ServiceAnnotationLoadBalancerInternal
+// picks. ServiceAnnotationLoadBalancerInternal still determines the primary frontend (the one
+// whose IP backs LoadBalancerIP/the pinned-IP annotations); this only keeps the complementary LB
+// from being torn down by cleanupLoadBalancer, reconciles it the same as the primary, and appends
+// its ingress to LoadBalancerStatus. Internal and external services are already two distinct ARM
+// LoadBalancer resources in this provider (see getLoadBalancerName), so this reuses that split
+// rather than attempting multiple frontend IP configurations on a single LB.
+const ServiceAnnotationLoadBalancerAdditionalFrontend = "service.beta.kubernetes.io/azure-load-balancer-additional-frontend"
+
+// additionalFrontendRequested reports whether service opted into
+// ServiceAnnotationLoadBalancerAdditionalFrontend.
+func additionalFrontendRequested(service *v1.Service) bool {
+	return service.Annotations[ServiceAnnotationLoadBalancerAdditionalFrontend] == "true"
+}
+
+// ServiceAnnotationLoadBalancerName shards this service onto a load balancer named after the
+// annotation value instead of the cluster's own default LB (getLoadBalancerName(clusterName,
+// ...)). Large clusters can run into the per-LB rule limit with every service landing on one LB;
+// this lets an operator spread services across several named LBs by hand. isInternal still
+// decides which of the two per-name LBs (the plain name, or "<name>-internal") a service lands
+// on, exactly as it does for the cluster-default LB.
+const ServiceAnnotationLoadBalancerName = "service.beta.kubernetes.io/azure-load-balancer-name"
+
+// azureLBNameRE matches a well-formed Azure load balancer resource name: 1-80 characters,
+// starting with a letter or digit, made up of letters, digits, underscores, periods and hyphens,
+// and ending with a letter, digit or underscore.
+var azureLBNameRE = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]{0,78}[a-zA-Z0-9_])?$`)
+
+// resolveLoadBalancerBaseName returns the name this service's LB should be based on -
+// ServiceAnnotationLoadBalancerName if set and valid, else clusterName - for getLoadBalancerName
+// to then suffix with "-internal" as appropriate. Keeping this independent of isInternal means a
+// service sharded onto a named LB still gets a separate internal/external pair, the same split
+// every other service gets off the cluster-default LB.
+func resolveLoadBalancerBaseName(clusterName string, service *v1.Service) (string, error) {
+	name, ok := service.Annotations[ServiceAnnotationLoadBalancerName]
+	if !ok || name == "" {
+		return clusterName, nil
+	}
+	if !azureLBNameRE.MatchString(name) {
+		return "", fmt.Errorf("unsupported value %q for annotation %s: not a well-formed Azure load balancer name", name, ServiceAnnotationLoadBalancerName)
+	}
+	return name, nil
+}
+
+// ServiceAnnotationLoadBalancerBackendPort overrides the BackendPort generated
+// LoadBalancingRules target, decoupling it from both the port's NodePort and, with
+// ServiceAnnotationLoadBalancerEnableFloatingIP, its own Port. This lets the LB hit a fixed
+// container port directly (e.g. via floating IP/DSR to a pod port that's the same across nodes)
+// regardless of what NodePort Kubernetes happened to allocate.
+const ServiceAnnotationLoadBalancerBackendPort = "service.beta.kubernetes.io/azure-load-balancer-backend-port"
+
+// ServiceAnnotationLoadBalancerUDPHealthProbePort lets a UDP service opt into health probing by
+// naming a TCP port that a Tcp probe should target instead. Azure load balancer probes can't
+// target a UDP rule directly, so without this a UDP rule's backend pool membership never
+// reacts to node health and an unhealthy node keeps receiving traffic. This only makes sense
+// when the pod backing the UDP port also serves a TCP port (e.g. a readiness/admin endpoint)
+// that's a reasonable proxy for its health.
+const ServiceAnnotationLoadBalancerUDPHealthProbePort = "service.beta.kubernetes.io/azure-load-balancer-udp-health-probe-port"
+
+// ServiceAnnotationLoadBalancerSharedProbe, when "true", consolidates a service's per-port
+// health probes into a single Tcp probe on the service's first non-UDP port, shared by all of
+// its rules, instead of one probe per port. This lowers the total probe count on LBs carrying
+// many multi-port services, at the cost of no longer distinguishing which individual port is
+// unhealthy. Ignored for services requiring externalTrafficPolicy: Local health checks, since
+// those already probe a single, fixed node health check port shared across rules.
+const ServiceAnnotationLoadBalancerSharedProbe = "service.beta.kubernetes.io/azure-load-balancer-shared-probe"
+
+// ServiceAnnotationLoadBalancerIdleTimeout sets IdleTimeoutInMinutes on the load balancing
+// rules for a service, overriding loadBalancerRuleIdleTimeoutDefault. Azure accepts values
+// from 4 to 30 minutes.
+const ServiceAnnotationLoadBalancerIdleTimeout = "service.beta.kubernetes.io/azure-load-balancer-tcp-idle-timeout"
+
+// ServiceAnnotationLoadBalancerStagedRemoval staggers removal of a load balancing rule that's
+// no longer wanted (port removed, or service deleted) across two reconciles: the first drops
+// the rule's probe so new traffic stops being routed to it, and the next reconcile drops the
+// rule itself, by which point in-flight connections have had a chance to drain.
+const ServiceAnnotationLoadBalancerStagedRemoval = "service.beta.kubernetes.io/azure-load-balancer-staged-removal"
+
+// ServiceAnnotationLoadBalancerBackendPool routes a service's load balancing rules to a
+// named backend pool instead of the default cluster-wide pool, letting distinct node groups
+// (e.g. spot vs on-demand) each have their own pool. Nodes join a named pool by carrying the
+// matching value in the nodePoolLabel label; nodes without that label stay in the default
+// pool. The named pool is created automatically if it doesn't already exist on the LB.
+const ServiceAnnotationLoadBalancerBackendPool = "service.beta.kubernetes.io/azure-load-balancer-backend-pool"
+
+// nodePoolLabel identifies which named backend pool a node belongs to, for services using
+// ServiceAnnotationLoadBalancerBackendPool. Nodes without this label belong to the default
+// pool named after the cluster.
+const nodePoolLabel = "kubernetes.azure.com/agentpool"
+
+// ServiceAnnotationLoadBalancerSharedIP lets several Services share a single frontend IP
+// configuration, and the public IP behind it, instead of each getting its own - useful for
+// clusters running many small services that would otherwise exhaust the subscription's public
+// IP quota. All Services naming the same value share the frontend; reconcileLoadBalancer still
+// rejects (or, per LoadBalancerFrontendPortConflictPolicy, reassigns) a port collision between
+// them, and the public IP is only torn down once no sharing Service still references it.
+const ServiceAnnotationLoadBalancerSharedIP = "service.beta.kubernetes.io/azure-shared-frontend-ip"
+
+// ServiceAnnotationLoadBalancerRuleProtocol overrides the transport protocol the
+// LoadBalancingRule uses, independent of the Service's declared port protocol. Some backends
+// expect every rule to carry plain TCP (e.g. a proxy protocol listener multiplexing what the
+// Service describes as UDP for bookkeeping purposes only). The NSG rule and health probe still
+// use the Service's own declared protocol, since the traffic actually arriving at the node
+// hasn't changed - only how the load balancer rule itself is provisioned.
+const ServiceAnnotationLoadBalancerRuleProtocol = "service.beta.kubernetes.io/azure-load-balancer-rule-protocol"
+
+// ServiceAnnotationLoadBalancerIPv6 requests an IPv6 public IP (PublicIPAddressVersion IPv6)
+// for a service's provider-created frontend, instead of the default IPv4 one. The vendored
+// network SDK's FrontendIPConfigurationPropertiesFormat has no PrivateIPAddressVersion field, so
+// this only affects external (non-internal) load balancers; an IPv6 internal frontend isn't
+// representable here. A service can only have one version at a time - true dual-stack (an IPv4
+// and an IPv6 frontend simultaneously) needs more than one frontend IP configuration per
+// service, which reconcileLoadBalancer doesn't yet support.
+const ServiceAnnotationLoadBalancerIPv6 = "service.beta.kubernetes.io/azure-load-balancer-ipv6"
+
+// frontendIPConfigKey returns the key a service's frontend IP configuration (and the public IP
+// behind it) should be named from: ServiceAnnotationLoadBalancerSharedIP's value when the
+// service opts into sharing, or the service's own load balancer name otherwise. Multiple
+// services naming the same shared key end up pointed at the same frontend IP config/PIP.
+func frontendIPConfigKey(service *v1.Service) string {
+	if shared, ok := service.Annotations[ServiceAnnotationLoadBalancerSharedIP]; ok && shared != "" {
+		return shared
+	}
+	return cloudprovider.GetLoadBalancerName(service)
+}
+
+// frontendIPConfigInUseByOtherService reports whether frontendIPConfigID is still referenced by
+// a load balancing rule that doesn't belong to service - i.e. another service sharing the same
+// frontend IP configuration via ServiceAnnotationLoadBalancerSharedIP. Used to avoid tearing down
+// a shared frontend config, or the public IP behind it, while it's still in use.
+func (az *Cloud) frontendIPConfigInUseByOtherService(lb network.LoadBalancer, service *v1.Service, frontendIPConfigID string) bool {
+	if lb.LoadBalancingRules == nil {
+		return false
+	}
+	for _, rule := range *lb.LoadBalancingRules {
+		if rule.Name != nil && serviceOwnsRule(service, *rule.Name) {
+			continue
+		}
+		if rule.LoadBalancingRulePropertiesFormat == nil || rule.FrontendIPConfiguration == nil {
+			continue
+		}
+		if strings.EqualFold(to.String(rule.FrontendIPConfiguration.ID), frontendIPConfigID) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	healthProbeDefaultIntervalInSeconds = 5
+	healthProbeDefaultNumberOfProbes    = 2
+	healthProbeDefaultRequestPath       = "/"
+
+	// loadBalancerRuleIdleTimeoutDefault is Azure's own default when IdleTimeoutInMinutes is
+	// left unset, used here so reconcile always has a concrete expected value to compare
+	// against the existing rule's timeout.
+	loadBalancerRuleIdleTimeoutDefault int32 = 4
+	loadBalancerRuleIdleTimeoutMinimum int32 = 4
+	loadBalancerRuleIdleTimeoutMaximum int32 = 30
+
+	// pipDeleteInUseRetryAttempts bounds how many delete attempts, the first one included,
+	// ensurePublicIPDeleted makes for a delete that Azure rejected because the PIP still looked in use by the frontend we just
+	// detached it from in the preceding LB update - eventual consistency on Azure's side.
+	pipDeleteInUseRetryAttempts = 3
+	// pipDeleteInUseRetryInterval is how long ensurePublicIPDeleted waits between retries.
+	pipDeleteInUseRetryInterval = 5 * time.Second
+
+	// probeProtocolHTTPS is not yet defined by the vendored azure-sdk-for-go as a named
+	// constant, but the Azure API itself accepts it; ProbeProtocol is just a string type.
+	probeProtocolHTTPS network.ProbeProtocol = "Https"
+
+	// azureLoadBalancerSourceTag is the Azure network service tag covering the load
+	// balancer's health-probe source IPs.
+	azureLoadBalancerSourceTag = "AzureLoadBalancer"
+	// azureLoadBalancerTagRulePriorityBase is the start of a reserved, stable priority
+	// range (below loadBalancerMinimumPriority) used for the AzureLoadBalancer allow
+	// rules, so they don't shift around as user rules are added/removed.
+	azureLoadBalancerTagRulePriorityBase int32 = 100
+	// azureLoadBalancerDenyAllSourceAddressPrefix marks the fail-closed deny rule added
+	// alongside restrictive LoadBalancerSourceRanges.
+	azureLoadBalancerDenyAllSourceAddressPrefix = "DenyAll"
+	// azureLoadBalancerDenyAllRulePriorityBase is the start of a reserved, stable priority
+	// range just below loadBalancerMaximumPriority, used for the fail-closed deny rules so
+	// they always evaluate after the specific source-range allow rules.
+	azureLoadBalancerDenyAllRulePriorityBase int32 = loadBalancerMaximumPriority - 100
+
+	// virtualNetworkSourceTag restricts an NSG rule's source to the vnet, used as the default
+	// source for internal services instead of a broad allow.
+	virtualNetworkSourceTag = "VirtualNetwork"
+
+	// clusterOwnershipTagKey tags an LB/NSG/PIP with the name of the cluster that manages
+	// it, for canModifyResource to check before writing to a possibly shared resource.
+	clusterOwnershipTagKey = "kubernetes-cluster-name"
+
+	// loadBalancerBackendPoolConfigurationTypeNodeIPConfiguration enrolls a node into the
+	// backend pool by attaching its primary NIC IP configuration. This is the default and
+	// the only strategy this vendored Azure SDK actually supports.
+	loadBalancerBackendPoolConfigurationTypeNodeIPConfiguration = "nodeIPConfiguration"
+	// loadBalancerBackendPoolConfigurationTypeNodeVM would enroll a node by VM reference
+	// instead of by NIC IP configuration, but network.BackendAddressPoolPropertiesFormat in
+	// this vendored SDK only models membership through BackendIPConfigurations, so this
+	// strategy is rejected rather than silently enrolling through the NIC path anyway. This is
+	// one of the tracked SDK-gap rejections listed in Config's doc comment, not a partial
+	// implementation.
+	loadBalancerBackendPoolConfigurationTypeNodeVM = "nodeVM"
+
+	// loadBalancerFrontendPortConflictPolicyError rejects a service's rule outright when
+	// another service already owns the same frontend+port on a shared LB frontend (e.g. two
+	// services pinned to the same loadBalancerIP). This is the default, and matches this
+	// provider's pre-existing behavior of surfacing the eventual Azure API rejection early
+	// and with a clearer message.
+	loadBalancerFrontendPortConflictPolicyError = "Error"
+	// loadBalancerFrontendPortConflictPolicyReassign moves a service off the frontend it
+	// asked for and onto its own, cluster-managed frontend when the one it asked for is
+	// already occupied for that port, rather than failing.
+	loadBalancerFrontendPortConflictPolicyReassign = "Reassign"
+
+	// defaultSecurityRuleMaximum is Azure's default per-NSG rule cap, used when
+	// Config.SecurityRuleMaximum is unset.
+	defaultSecurityRuleMaximum = 1000
+)
+
+// securityRuleMaximum resolves the configured per-NSG rule cap, defaulting to Azure's
+// standard limit when unset.
+func securityRuleMaximum(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	return defaultSecurityRuleMaximum
+}
+
+// canModifyResource reports whether this cluster is allowed to create, update, or delete
+// an Azure resource given its current tags. When EnableClusterOwnershipTagCheck is unset,
+// every resource is modifiable, preserving this provider's pre-existing behavior. When set,
+// a resource already tagged for this cluster may be modified; a resource tagged for a
+// different cluster never may; an untagged resource may only be modified (adopted) if
+// AdoptUntaggedAzureResources is also set.
+func (az *Cloud) canModifyResource(tags *map[string]*string, clusterName string) bool {
+	if !az.EnableClusterOwnershipTagCheck {
+		return true
+	}
+	if tags == nil || *tags == nil {
+		return az.AdoptUntaggedAzureResources
+	}
+	owner, tagged := (*tags)[clusterOwnershipTagKey]
+	if !tagged || owner == nil || *owner == "" {
+		return az.AdoptUntaggedAzureResources
+	}
+	return *owner == clusterName
+}
+
+// tagResourceForCluster returns a copy of tags with Config.Tags and this cluster's ownership
+// tag set, for claiming a resource that canModifyResource found to be adoptable.
+// clusterOwnershipTagKey always wins over a same-named entry in Config.Tags, since ownership
+// has to be unambiguous for canModifyResource to trust it on a later reconcile.
+func (az *Cloud) tagResourceForCluster(tags *map[string]*string, clusterName string) *map[string]*string {
+	claimed := map[string]*string{}
+	if tags != nil {
+		for k, v := range *tags {
+			claimed[k] = v
+		}
+	}
+	for k, v := range az.Tags {
+		claimed[k] = to.StringPtr(v)
+	}
+	claimed[clusterOwnershipTagKey] = to.StringPtr(clusterName)
+	return &claimed
+}
+
+// probeConfig is the fully resolved health probe configuration for a single service port,
+// after applying service spec, service annotations and cloud config defaults in that order
+// of precedence. It is nil for ports that should not get a probe at all (UDP).
+type probeConfig struct {
+	Protocol          network.ProbeProtocol
+	Port              int32
+	RequestPath       string
+	IntervalInSeconds int32
+	NumberOfProbes    int32
+}
+
+// resolveProbeConfig computes the probe that reconcileLoadBalancer should create for the given
+// service port. It is pure (no network calls) so it can be tested independently of any Azure
+// client. defaultProbeProto is the probe protocol implied by port.Protocol, as returned by
+// getProtocolsFromKubernetesProtocol; it is nil for UDP ports, which get no probe unless
+// ServiceAnnotationLoadBalancerUDPHealthProbePort opts them into a Tcp probe.
+func (az *Cloud) resolveProbeConfig(service *v1.Service, port v1.ServicePort, defaultProbeProto *network.ProbeProtocol) (*probeConfig, error) {
+	if defaultProbeProto == nil {
+		return az.resolveUDPHealthProbeConfig(service)
+	}
+
+	cfg := &probeConfig{
+		IntervalInSeconds: healthProbeDefaultIntervalInSeconds,
+		NumberOfProbes:    healthProbeDefaultNumberOfProbes,
+	}
+	if az.LoadBalancerProbeIntervalInSeconds != 0 {
+		cfg.IntervalInSeconds = az.LoadBalancerProbeIntervalInSeconds
+	}
+	if az.LoadBalancerProbeNumberOfProbes != 0 {
+		cfg.NumberOfProbes = az.LoadBalancerProbeNumberOfProbes
+	}
+
+	// externalTrafficPolicy: Local always wins: the node health port must be probed over Http,
+	// regardless of any health-probe annotation, so unhealthy nodes keep being drained.
+	if serviceapi.NeedsHealthCheck(service) {
+		podPresencePath, podPresencePort := serviceapi.GetServiceHealthCheckPathPort(service)
+		cfg.Protocol = network.ProbeProtocolHTTP
+		cfg.RequestPath = podPresencePath
+		cfg.Port = podPresencePort
+		return cfg, nil
+	}
+
+	cfg.Port = port.NodePort
+	cfg.Protocol = *defaultProbeProto
+	if override, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthProbeProtocol]; ok && override != "" {
+		switch strings.ToLower(override) {
+		case "http":
+			cfg.Protocol = network.ProbeProtocolHTTP
+		case "https":
+			cfg.Protocol = probeProtocolHTTPS
+		case "tcp":
+			cfg.Protocol = network.ProbeProtocolTCP
+		default:
+			return nil, fmt.Errorf("unsupported value %q for annotation %s", override, ServiceAnnotationLoadBalancerHealthProbeProtocol)
+		}
+	}
+
+	if portOverride, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthProbePort]; ok && portOverride != "" {
+		parsed, err := strconv.ParseInt(portOverride, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value %q for annotation %s: %v", portOverride, ServiceAnnotationLoadBalancerHealthProbePort, err)
+		}
+		cfg.Port = int32(parsed)
+	}
+
+	if cfg.Protocol == network.ProbeProtocolHTTP || cfg.Protocol == probeProtocolHTTPS {
+		cfg.RequestPath = healthProbeDefaultRequestPath
+		if path, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthProbeRequestPath]; ok && path != "" {
+			cfg.RequestPath = path
+		}
+	}
+
+	if intervalOverride, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthProbeInterval]; ok && intervalOverride != "" {
+		parsed, err := strconv.ParseInt(intervalOverride, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value %q for annotation %s: %v", intervalOverride, ServiceAnnotationLoadBalancerHealthProbeInterval, err)
+		}
+		cfg.IntervalInSeconds = int32(parsed)
+	}
+
+	if numOfProbeOverride, ok := service.Annotations[ServiceAnnotationLoadBalancerHealthProbeNumOfProbe]; ok && numOfProbeOverride != "" {
+		parsed, err := strconv.ParseInt(numOfProbeOverride, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value %q for annotation %s: %v", numOfProbeOverride, ServiceAnnotationLoadBalancerHealthProbeNumOfProbe, err)
+		}
+		cfg.NumberOfProbes = int32(parsed)
+	}
+
+	return cfg, nil
+}
+
+// resolveUDPHealthProbeConfig builds the Tcp probe for a UDP port whose service opts in via
+// ServiceAnnotationLoadBalancerUDPHealthProbePort. Returns nil, nil when the annotation isn't
+// set, leaving the port unprobed just like before this annotation existed.
+func (az *Cloud) resolveUDPHealthProbeConfig(service *v1.Service) (*probeConfig, error) {
+	override, ok := service.Annotations[ServiceAnnotationLoadBalancerUDPHealthProbePort]
+	if !ok || override == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseInt(override, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value %q for annotation %s: %v", override, ServiceAnnotationLoadBalancerUDPHealthProbePort, err)
+	}
+
+	cfg := &probeConfig{
+		Protocol:          network.ProbeProtocolTCP,
+		Port:              int32(parsed),
+		IntervalInSeconds: healthProbeDefaultIntervalInSeconds,
+		NumberOfProbes:    healthProbeDefaultNumberOfProbes,
+	}
+	if az.LoadBalancerProbeIntervalInSeconds != 0 {
+		cfg.IntervalInSeconds = az.LoadBalancerProbeIntervalInSeconds
+	}
+	if az.LoadBalancerProbeNumberOfProbes != 0 {
+		cfg.NumberOfProbes = az.LoadBalancerProbeNumberOfProbes
+	}
+	return cfg, nil
+}
+
+// stagedRemovalEnabled reports whether a service has opted into staged rule removal via
+// ServiceAnnotationLoadBalancerStagedRemoval.
+func stagedRemovalEnabled(service *v1.Service) bool {
+	enabled, ok := service.Annotations[ServiceAnnotationLoadBalancerStagedRemoval]
+	return ok && enabled == "true"
+}
+
+// fqdnRE matches a well-formed, fully-qualified DNS name: dot-separated labels of letters,
+// digits and hyphens, with at least two labels (a bare hostname isn't a valid reverse FQDN).
+var fqdnRE = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,}\.?$`)
+
+// resolvePIPReverseFqdn returns the reverse FQDN a service's provider-created public IP
+// should carry, via ServiceAnnotationPIPReverseFqdn, validating it's a well-formed FQDN.
+func resolvePIPReverseFqdn(service *v1.Service) (string, error) {
+	fqdn, ok := service.Annotations[ServiceAnnotationPIPReverseFqdn]
+	if !ok || fqdn == "" {
+		return "", nil
+	}
+	if !fqdnRE.MatchString(fqdn) {
+		return "", fmt.Errorf("unsupported value %q for annotation %s: not a well-formed FQDN", fqdn, ServiceAnnotationPIPReverseFqdn)
+	}
+	return fqdn, nil
+}
+
+// dnsLabelRE matches a well-formed Azure DNS label: a single, non-dotted segment of letters,
+// digits and hyphens, 1-63 characters, that doesn't start or end with a hyphen.
+var dnsLabelRE = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// resolveDNSLabel returns the DNS label a service's provider-created public IP should carry,
+// via ServiceAnnotationLoadBalancerDNSLabel, validating it's a well-formed single DNS label.
+func resolveDNSLabel(service *v1.Service) (string, error) {
+	label, ok := service.Annotations[ServiceAnnotationLoadBalancerDNSLabel]
+	if !ok || label == "" {
+		return "", nil
+	}
+	if !dnsLabelRE.MatchString(label) {
+		return "", fmt.Errorf("unsupported value %q for annotation %s: not a well-formed DNS label", label, ServiceAnnotationLoadBalancerDNSLabel)
+	}
+	return label, nil
+}
+
+// applyDNSLabel updates pip's DomainNameLabel to wanted ("" clears it), reporting whether
+// that's a change from its current value.
+func applyDNSLabel(pip network.PublicIPAddress, wanted string) (network.PublicIPAddress, bool) {
+	current := ""
+	if pip.DNSSettings != nil && pip.DNSSettings.DomainNameLabel != nil {
+		current = *pip.DNSSettings.DomainNameLabel
+	}
+	if current == wanted {
+		return pip, false
+	}
+	if wanted == "" {
+		pip.DNSSettings = nil
+	} else if pip.DNSSettings != nil {
+		pip.DNSSettings.DomainNameLabel = to.StringPtr(wanted)
+	} else {
+		pip.DNSSettings = &network.PublicIPAddressDNSSettings{DomainNameLabel: to.StringPtr(wanted)}
+	}
+	return pip, true
+}
+
+// internalAllowsBroadSource reports whether an internal service has opted into a broad
+// "Internet" NSG source via ServiceAnnotationLoadBalancerInternalAllowBroadSource, instead of
+// the default VirtualNetwork-restricted source.
+func internalAllowsBroadSource(service *v1.Service) bool {
+	allow, ok := service.Annotations[ServiceAnnotationLoadBalancerInternalAllowBroadSource]
+	return ok && allow == "true"
+}
+
+// floatingIPEnabled reports whether ServiceAnnotationLoadBalancerEnableFloatingIP opted this
+// service's load balancing rules into floating IP (Direct Server Return).
+func floatingIPEnabled(service *v1.Service) bool {
+	enabled, ok := service.Annotations[ServiceAnnotationLoadBalancerEnableFloatingIP]
+	return ok && enabled == "true"
+}
+
+// isPIPInUseError reports whether err looks like Azure rejecting a PIP delete because the PIP
+// is still considered in use by a resource we just detached it from - e.g. the LB frontend
+// removed by the reconcile immediately preceding this delete. This is retryable: the PIP
+// becomes deletable once Azure's state catches up.
+func isPIPInUseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "InUse")
+}
+
+// deletePublicIPWithInUseRetry calls deleteFn up to attempts times, retrying after sleep
+// whenever its error looks like isPIPInUseError. deleteFn and sleep are injected so this
+// retry sequencing can be tested without a client or real waiting.
+func deletePublicIPWithInUseRetry(deleteFn func() error, attempts int, sleep func()) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = deleteFn()
+		if !isPIPInUseError(err) {
+			return err
+		}
+		if attempt < attempts-1 {
+			sleep()
+		}
+	}
+	return err
+}
+
+// resolvePIPAllocationMethod returns the allocation method a service's provider-created
+// public IP should have, via ServiceAnnotationPIPAllocationMethod, defaulting to Static.
+func resolvePIPAllocationMethod(service *v1.Service) (network.IPAllocationMethod, error) {
+	method, ok := service.Annotations[ServiceAnnotationPIPAllocationMethod]
+	if !ok || method == "" {
+		return network.Static, nil
+	}
+	switch strings.ToLower(method) {
+	case "static":
+		return network.Static, nil
+	case "dynamic":
+		return network.Dynamic, nil
+	default:
+		return "", fmt.Errorf("unsupported value %q for annotation %s: must be %q or %q", method, ServiceAnnotationPIPAllocationMethod, network.Static, network.Dynamic)
+	}
+}
+
+// applyPIPAllocationMethod sets pip's allocation method to wanted if it differs, returning the
+// (possibly updated) PIP and whether a change was made. It's pure so the in-place Dynamic ->
+// Static conversion ensurePublicIPExists performs can be tested without a client.
+func applyPIPAllocationMethod(pip network.PublicIPAddress, wanted network.IPAllocationMethod) (network.PublicIPAddress, bool) {
+	if pip.PublicIPAddressPropertiesFormat.PublicIPAllocationMethod == wanted {
+		return pip, false
+	}
+	pip.PublicIPAddressPropertiesFormat.PublicIPAllocationMethod = wanted
+	return pip, true
+}
+
+// resolvePublicIPAddressVersion returns the IP version a service's provider-created public IP
+// should have, via ServiceAnnotationLoadBalancerIPv6, defaulting to IPv4.
+func resolvePublicIPAddressVersion(service *v1.Service) network.IPVersion {
+	if v, ok := service.Annotations[ServiceAnnotationLoadBalancerIPv6]; ok {
+		if requested, err := strconv.ParseBool(v); err == nil && requested {
+			return network.IPv6
+		}
+	}
+	return network.IPv4
+}
+
+// publicIPAddressVersionMismatch reports whether pip's existing IP version differs from wanted.
+// Unlike allocation method or DNS label, Azure does not support changing a PIP's version in
+// place, so ensurePublicIPExists can't reconcile a mismatch itself the way it does for those -
+// it surfaces an error instead of silently keeping the old version or recreating the PIP (which
+// would hand the service a different address). An empty existing version reads as IPv4, Azure's
+// default, so pre-existing PIPs created before this annotation was understood aren't flagged.
+func publicIPAddressVersionMismatch(pip network.PublicIPAddress, wanted network.IPVersion) bool {
+	existing := pip.PublicIPAddressPropertiesFormat.PublicIPAddressVersion
+	if existing == "" {
+		existing = network.IPv4
+	}
+	return existing != wanted
+}
+
+// healthCheckNodePortRule returns the ServicePort the NSG needs to open for the Azure load
+// balancer's own health probe against this service's HealthCheckNodePort, and whether one is
+// needed at all. It's only needed for externalTrafficPolicy: Local services (see
+// serviceapi.NeedsHealthCheck): those route the probe straight to HealthCheckNodePort rather
+// than to one of the service's own Ports, so the regular per-port rule loop above never opens
+// it, and without this rule a restrictive LoadBalancerSourceRanges (see needsAzureLoadBalancerTag)
+// would leave the probe unreachable and every node falsely marked unhealthy.
+func healthCheckNodePortRule(service *v1.Service) (v1.ServicePort, bool) {
+	_, port := serviceapi.GetServiceHealthCheckPathPort(service)
+	if port == 0 {
+		return v1.ServicePort{}, false
+	}
+	return v1.ServicePort{Protocol: v1.ProtocolTCP, Port: port}, true
+}
+
+// resolveBackendPoolName returns the backend pool a service's load balancing rules should
+// target: the pool named by ServiceAnnotationLoadBalancerBackendPool if the service opts in,
+// or the default cluster-wide pool otherwise.
+func resolveBackendPoolName(clusterName string, service *v1.Service) string {
+	if pool, ok := service.Annotations[ServiceAnnotationLoadBalancerBackendPool]; ok && pool != "" {
+		return pool
+	}
+	return getBackendPoolName(clusterName)
+}
+
+// nodeBackendPoolName returns the named backend pool a node belongs to, based on nodePoolLabel,
+// falling back to the default cluster-wide pool for nodes that don't carry the label.
+func nodeBackendPoolName(node *v1.Node, clusterName string) string {
+	if pool, ok := node.Labels[nodePoolLabel]; ok && pool != "" {
+		return pool
+	}
+	return getBackendPoolName(clusterName)
+}
+
+// filterNodesByBackendPool returns the subset of nodes that belong to the named backend pool,
+// per nodeBackendPoolName. It is pure so the node-group routing can be tested without a client.
+func filterNodesByBackendPool(nodes []*v1.Node, clusterName, backendPoolName string) []*v1.Node {
+	var filtered []*v1.Node
+	for _, node := range nodes {
+		if nodeBackendPoolName(node, clusterName) == backendPoolName {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// excludeMasterNodes drops nodes labeled labelNodeRoleMaster from nodes when exclude is true,
+// and is a no-op otherwise. It's called on the Standard LB backend pool path, gated by
+// ExcludeMasterFromStandardLB: unlike Basic LB, Standard LB can front masters too, so whether
+// they're kept out of the pool has to be an explicit choice rather than always-on.
+func excludeMasterNodes(nodes []*v1.Node, exclude bool) []*v1.Node {
+	if !exclude {
+		return nodes
+	}
+	var filtered []*v1.Node
+	for _, node := range nodes {
+		if _, ok := node.Labels[labelNodeRoleMaster]; ok {
+			continue
+		}
+		filtered = append(filtered, node)
+	}
+	return filtered
+}
+
+const (
+	// labelNodeRoleMaster mirrors pkg/controller/service's LabelNodeRoleMaster: nodes carrying
+	// it are excluded from backend pool membership computed from the node lister, the same as
+	// the service controller already excludes them from the node slice it hands this provider.
+	labelNodeRoleMaster = "node-role.kubernetes.io/master"
+	// labelNodeRoleExcludeBalancer mirrors pkg/controller/service's LabelNodeRoleExcludeBalancer.
+	labelNodeRoleExcludeBalancer = "alpha.service-controller.kubernetes.io/exclude-balancer"
+	// labelNodeExcludeFromExternalLB marks a node (e.g. a dedicated batch node) that should
+	// never receive external load balancer traffic, regardless of which backend pool it would
+	// otherwise belong to. Unlike labelNodeRoleExcludeBalancer it's owned by node lifecycle
+	// rather than the service controller, so ensureLoadBalancer checks it directly instead of
+	// folding it into eligibleForBackendPool's service-controller-mirrored checks.
+	labelNodeExcludeFromExternalLB = "node.kubernetes.io/exclude-from-external-load-balancers"
+)
+
+// excludeLabeledNodes splits nodes into those still eligible for backend pool membership and
+// those excluded via labelNodeExcludeFromExternalLB. ensureLoadBalancer uses excluded both to
+// skip enrolling those nodes' NICs and, for ones already enrolled from before the label was
+// added, to remove them.
+func excludeLabeledNodes(nodes []*v1.Node) (included, excluded []*v1.Node) {
+	for _, node := range nodes {
+		if _, ok := node.Labels[labelNodeExcludeFromExternalLB]; ok {
+			excluded = append(excluded, node)
+			continue
+		}
+		included = append(included, node)
+	}
+	return included, excluded
+}
+
+// eligibleForBackendPool reports whether a node should be enrolled in a load balancer backend
+// pool, mirroring the exclusions (unschedulable, master role, exclude-balancer label) that
+// pkg/controller/service already applies before handing a node slice to this provider. It's
+// consulted by backendPoolNodesFromLister so membership computed from this provider's own
+// node lister doesn't diverge from what a caller-supplied slice would have contained.
+func eligibleForBackendPool(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	if _, ok := node.Labels[labelNodeRoleMaster]; ok {
+		return false
+	}
+	if _, ok := node.Labels[labelNodeRoleExcludeBalancer]; ok {
+		return false
+	}
+	return true
+}
+
+// backendPoolNodesFromLister lists the cluster's current nodes from az.nodeLister (wired up in
+// Initialize), filtered by eligibleForBackendPool, as an alternative to a caller-supplied node
+// slice that may have gone stale by the time a reconcile actually runs.
+func (az *Cloud) backendPoolNodesFromLister() ([]*v1.Node, error) {
+	if az.nodeLister == nil {
+		return nil, fmt.Errorf("no node lister configured: Initialize must run before reconciling backend pool membership from the lister")
+	}
+	nodes, err := az.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	eligible := make([]*v1.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if eligibleForBackendPool(node) {
+			eligible = append(eligible, node)
+		}
+	}
+	return eligible, nil
+}
+
+// ReconcileBackendPoolMembership ensures service's load balancer backend pool membership
+// matches the cluster's current nodes as seen by this provider's own node lister (see
+// Initialize), rather than a node slice the caller computed earlier. This decouples backend
+// pool freshness from the service controller's own resync cadence - a node added or removed
+// between the controller's last list and this call is still picked up.
+func (az *Cloud) ReconcileBackendPoolMembership(clusterName string, service *v1.Service) error {
+	nodes, err := az.backendPoolNodesFromLister()
+	if err != nil {
+		return err
+	}
+	_, err = az.ensureLoadBalancer(clusterName, service, nodes)
+	return err
+}
+
+// resolveLoadBalancerRuleIdleTimeout computes the IdleTimeoutInMinutes a service's load
+// balancing rules should have, applying the ServiceAnnotationLoadBalancerIdleTimeout override
+// over loadBalancerRuleIdleTimeoutDefault. It is pure so it can be tested without a client.
+func resolveLoadBalancerRuleIdleTimeout(service *v1.Service) (int32, error) {
+	override, ok := service.Annotations[ServiceAnnotationLoadBalancerIdleTimeout]
+	if !ok || override == "" {
+		return loadBalancerRuleIdleTimeoutDefault, nil
+	}
+	parsed, err := strconv.ParseInt(override, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported value %q for annotation %s: %v", override, ServiceAnnotationLoadBalancerIdleTimeout, err)
+	}
+	timeout := int32(parsed)
+	if timeout < loadBalancerRuleIdleTimeoutMinimum || timeout > loadBalancerRuleIdleTimeoutMaximum {
+		return 0, fmt.Errorf("unsupported value %q for annotation %s: must be between %d and %d", override, ServiceAnnotationLoadBalancerIdleTimeout, loadBalancerRuleIdleTimeoutMinimum, loadBalancerRuleIdleTimeoutMaximum)
+	}
+	return timeout, nil
+}
+
+// resolveBackendPort returns the BackendPort a generated LoadBalancingRule should target,
+// honouring ServiceAnnotationLoadBalancerBackendPort when set and otherwise falling back to
+// defaultBackendPort (NodePort, or Port when floating IP is enabled).
+func resolveBackendPort(service *v1.Service, defaultBackendPort int32) (int32, error) {
+	override, ok := service.Annotations[ServiceAnnotationLoadBalancerBackendPort]
+	if !ok || override == "" {
+		return defaultBackendPort, nil
+	}
+	parsed, err := strconv.ParseInt(override, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported value %q for annotation %s: %v", override, ServiceAnnotationLoadBalancerBackendPort, err)
+	}
+	backendPort := int32(parsed)
+	if backendPort < 1 || backendPort > 65535 {
+		return 0, fmt.Errorf("unsupported value %q for annotation %s: must be between 1 and 65535", override, ServiceAnnotationLoadBalancerBackendPort)
+	}
+	return backendPort, nil
+}
+
+// resolveLoadBalancerRuleProtocol returns the TransportProtocol a generated LoadBalancingRule
+// should use, honouring ServiceAnnotationLoadBalancerRuleProtocol when set and otherwise
+// falling back to defaultProto (derived from the port's own declared protocol).
+func resolveLoadBalancerRuleProtocol(service *v1.Service, defaultProto network.TransportProtocol) (network.TransportProtocol, error) {
+	override, ok := service.Annotations[ServiceAnnotationLoadBalancerRuleProtocol]
+	if !ok || override == "" {
+		return defaultProto, nil
+	}
+	switch strings.ToLower(override) {
+	case "tcp":
+		return network.TransportProtocolTCP, nil
+	case "udp":
+		return network.TransportProtocolUDP, nil
+	default:
+		return "", fmt.Errorf("unsupported value %q for annotation %s: must be %q or %q", override, ServiceAnnotationLoadBalancerRuleProtocol, network.TransportProtocolTCP, network.TransportProtocolUDP)
+	}
+}
+
 // GetLoadBalancer returns whether the specified load balancer exists, and
 // if so, what its status is.
 func (az *Cloud) GetLoadBalancer(clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
 	isInternal := requiresInternalLoadBalancer(service)
-	lbName := getLoadBalancerName(clusterName, isInternal)
+	status, exists, err = az.getLoadBalancerStatusForFrontend(clusterName, service, isInternal)
+	if err != nil || !exists || !additionalFrontendRequested(service) {
+		return status, exists, err
+	}
+
+	// ServiceAnnotationLoadBalancerAdditionalFrontend also wants the complementary (internal vs
+	// external) LB's ingress reported, not just the primary one azure-load-balancer-internal
+	// selects.
+	additionalStatus, additionalExists, err := az.getLoadBalancerStatusForFrontend(clusterName, service, !isInternal)
+	if err != nil {
+		return nil, false, err
+	}
+	if !additionalExists {
+		glog.V(5).Infof("get(%s): additional frontend doesn't exist yet", getServiceName(service))
+		return nil, false, nil
+	}
+	status.Ingress = append(status.Ingress, additionalStatus.Ingress...)
+	return status, true, nil
+}
+
+// getLoadBalancerStatusForFrontend is GetLoadBalancer's logic for a single LB (internal or
+// external), factored out so ServiceAnnotationLoadBalancerAdditionalFrontend can look up both of
+// a service's LBs independently.
+func (az *Cloud) getLoadBalancerStatusForFrontend(clusterName string, service *v1.Service, isInternal bool) (status *v1.LoadBalancerStatus, exists bool, err error) {
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
+	if err != nil {
+		return nil, false, err
+	}
+	lbName := getLoadBalancerName(lbBaseName, isInternal)
 	serviceName := getServiceName(service)
 
 	lb, existsLb, err := az.getAzureLoadBalancer(lbName)
@@ -56,6 +966,7 @@ func (az *Cloud) GetLoadBalancer(clusterName string, service *v1.Service) (statu
 	}
 
 	var lbIP *string
+	var lbHostname string
 
 	if isInternal {
 		lbFrontendIPConfigName := getFrontendIPConfigName(service, subnet(service))
@@ -71,26 +982,50 @@ func (az *Cloud) GetLoadBalancer(clusterName string, service *v1.Service) (statu
 		if err != nil {
 			return nil, false, err
 		}
-		pip, existsPip, err := az.getPublicIPAddress(pipName)
+		pip, existsPip, err := az.getPublicIPAddress(service.Annotations[ServiceAnnotationLoadBalancerPIPResourceGroup], pipName)
 		if err != nil {
 			return nil, false, err
 		}
 		if existsPip {
 			lbIP = pip.IPAddress
+			lbHostname = publicIPFqdn(pip)
 		}
 	}
 
-	if lbIP == nil {
+	if ipAddressPending(lbIP) {
 		glog.V(5).Infof("get(%s): lb(%s) - IP doesn't exist", serviceName, lbName)
 		return nil, false, nil
 	}
 
 	return &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{{IP: *lbIP}},
+		Ingress: []v1.LoadBalancerIngress{{IP: *lbIP, Hostname: lbHostname}},
 	}, true, nil
 }
 
+// ipAddressPending reports whether ip represents an address Azure hasn't actually assigned yet -
+// either because no frontend/PIP was found at all (nil) or because it was found but allocation
+// hasn't completed (a PIP with Dynamic allocation can exist with an empty IPAddress until it's
+// attached to something, and a PrivateIPAddress can likewise be empty right after creation). Both
+// must be treated the same way: "not ready yet", never surfaced as a literal empty-string ingress
+// IP.
+func ipAddressPending(ip *string) bool {
+	return ip == nil || *ip == ""
+}
+
+// publicIPFqdn returns the FQDN Azure assigned to a public IP's DNS label, or "" if the PIP
+// has no DNS settings (no label configured).
+func publicIPFqdn(pip network.PublicIPAddress) string {
+	if pip.PublicIPAddressPropertiesFormat == nil || pip.DNSSettings == nil || pip.DNSSettings.Fqdn == nil {
+		return ""
+	}
+	return *pip.DNSSettings.Fqdn
+}
+
 func (az *Cloud) determinePublicIPName(clusterName string, service *v1.Service) (string, error) {
+	if pipName, ok := service.Annotations[ServiceAnnotationLoadBalancerPublicIPName]; ok {
+		return pipName, nil
+	}
+
 	loadBalancerIP := service.Spec.LoadBalancerIP
 	if len(loadBalancerIP) == 0 {
 		return getPublicIPName(clusterName, service), nil
@@ -120,38 +1055,59 @@ func (az *Cloud) determinePublicIPName(clusterName string, service *v1.Service)
 
 // EnsureLoadBalancer creates a new load balancer 'name', or updates the existing one. Returns the status of the balancer
 func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	isInternal := requiresInternalLoadBalancer(service)
-	lbName := getLoadBalancerName(clusterName, isInternal)
+	status, err := az.ensureLoadBalancer(clusterName, service, nodes)
+	if err != nil {
+		az.recordReconcileFailure(service, err)
+	}
+	return status, err
+}
 
-	// When a client updates the internal load balancer annotation,
-	// the service may be switched from an internal LB to a public one, or vise versa.
-	// Here we'll firstly ensure service do not lie in the opposite LB.
-	err := az.cleanupLoadBalancer(clusterName, service, !isInternal)
+func (az *Cloud) ensureLoadBalancer(clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	isInternal := requiresInternalLoadBalancer(service)
+	wantsAdditionalFrontend := additionalFrontendRequested(service)
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
 	if err != nil {
 		return nil, err
 	}
+	lbName := getLoadBalancerName(lbBaseName, isInternal)
+
+	// When a client updates the internal load balancer annotation, the service may be switched
+	// from an internal LB to a public one, or vise versa. Here we'll firstly ensure service do
+	// not lie in the opposite LB - unless ServiceAnnotationLoadBalancerAdditionalFrontend wants
+	// it to exist there too, in which case the complementary LB is reconciled below instead of
+	// cleaned up.
+	if !wantsAdditionalFrontend {
+		err := az.cleanupLoadBalancer(clusterName, service, !isInternal)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	serviceName := getServiceName(service)
 	glog.V(5).Infof("ensure(%s): START clusterName=%q lbName=%q", serviceName, clusterName, lbName)
 
-	az.operationPollRateLimiter.Accept()
-	glog.V(10).Infof("SecurityGroupsClient.Get(%q): start", az.SecurityGroupName)
-	sg, err := az.SecurityGroupsClient.Get(az.ResourceGroup, az.SecurityGroupName, "")
-	glog.V(10).Infof("SecurityGroupsClient.Get(%q): end", az.SecurityGroupName)
+	sg, existsSg, err := az.getSecurityGroup()
 	if err != nil {
 		return nil, err
 	}
+	if !existsSg {
+		return nil, fmt.Errorf("ensure(%s): sg(%s) - not found", serviceName, az.SecurityGroupName)
+	}
 	sg, sgNeedsUpdate, err := az.reconcileSecurityGroup(sg, clusterName, service, true /* wantLb */)
 	if err != nil {
 		return nil, err
 	}
 	if sgNeedsUpdate {
+		if !az.canModifyResource(sg.Tags, clusterName) {
+			return nil, fmt.Errorf("ensure(%s): sg(%s) - refusing to modify, not tagged for cluster %q", serviceName, to.String(sg.Name), clusterName)
+		}
+		sg.Tags = az.tagResourceForCluster(sg.Tags, clusterName)
 		glog.V(3).Infof("ensure(%s): sg(%s) - updating", serviceName, *sg.Name)
 		// azure-sdk-for-go introduced contraint validation which breaks the updating here if we don't set these
 		// to nil. This is a workaround until https://github.com/Azure/go-autorest/issues/112 is fixed
 		sg.SecurityGroupPropertiesFormat.NetworkInterfaces = nil
 		sg.SecurityGroupPropertiesFormat.Subnets = nil
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("SecurityGroupsClient.CreateOrUpdate(%q): start", *sg.Name)
 		respChan, errChan := az.SecurityGroupsClient.CreateOrUpdate(az.ResourceGroup, *sg.Name, sg, nil)
 		resp := <-respChan
@@ -168,7 +1124,40 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 		if err != nil {
 			return nil, err
 		}
+		az.InvalidateCachedSecurityGroup()
+	}
+
+	primaryIngress, err := az.ensureLoadBalancerFrontend(clusterName, service, nodes, isInternal)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{*primaryIngress}}
+
+	if wantsAdditionalFrontend {
+		additionalIngress, err := az.ensureLoadBalancerFrontend(clusterName, service, nodes, !isInternal)
+		if err != nil {
+			return nil, err
+		}
+		status.Ingress = append(status.Ingress, *additionalIngress)
+	}
+
+	return status, nil
+}
+
+// ensureLoadBalancerFrontend reconciles a single LB (internal or external) for service - its
+// frontend IP/PIP, its rules/probes/backend pool via reconcileLoadBalancer, and its node backend
+// pool membership - and returns the ingress entry for it. This is ensureLoadBalancer's per-LB
+// core, factored out so ServiceAnnotationLoadBalancerAdditionalFrontend can reconcile both of a
+// service's LBs (e.g. one internal, one external, for split-horizon) in a single EnsureLoadBalancer
+// call.
+func (az *Cloud) ensureLoadBalancerFrontend(clusterName string, service *v1.Service, nodes []*v1.Node, isInternal bool) (*v1.LoadBalancerIngress, error) {
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
+	if err != nil {
+		return nil, err
 	}
+	lbName := getLoadBalancerName(lbBaseName, isInternal)
+	serviceName := getServiceName(service)
 
 	lb, existsLb, err := az.getAzureLoadBalancer(lbName)
 	if err != nil {
@@ -183,6 +1172,7 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 	}
 
 	var lbIP *string
+	var lbHostname string
 	var fipConfigurationProperties *network.FrontendIPConfigurationPropertiesFormat
 
 	if isInternal {
@@ -190,7 +1180,9 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 		if subnetName == nil {
 			subnetName = &az.SubnetName
 		}
-		subnet, existsSubnet, err := az.getSubnet(az.VnetName, *subnetName)
+		vnetResourceGroup := service.Annotations[ServiceAnnotationLoadBalancerInternalSubnetResourceGroup]
+		vnetSubscriptionID := service.Annotations[ServiceAnnotationLoadBalancerInternalSubnetSubscriptionID]
+		subnet, existsSubnet, err := az.getSubnetCrossSubscription(az.VnetName, *subnetName, vnetResourceGroup, vnetSubscriptionID)
 		if err != nil {
 			return nil, err
 		}
@@ -205,8 +1197,13 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 			},
 		}
 
-		loadBalancerIP := service.Spec.LoadBalancerIP
+		loadBalancerIP := resolveInternalLoadBalancerIP(service)
 		if loadBalancerIP != "" {
+			if subnet.AddressPrefix != nil {
+				if err := validateInternalLoadBalancerIP(loadBalancerIP, *subnet.AddressPrefix); err != nil {
+					return nil, fmt.Errorf("ensure(%s): lb(%s) - invalid pinned private IP: %v", serviceName, lbName, err)
+				}
+			}
 			configProperties.PrivateIPAllocationMethod = network.Static
 			configProperties.PrivateIPAddress = &loadBalancerIP
 			lbIP = &loadBalancerIP
@@ -221,12 +1218,13 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 		if err != nil {
 			return nil, err
 		}
-		pip, err := az.ensurePublicIPExists(serviceName, pipName)
+		pip, err := az.ensurePublicIPExists(service, pipName, service.Annotations[ServiceAnnotationLoadBalancerPIPResourceGroup], clusterName)
 		if err != nil {
 			return nil, err
 		}
 
 		lbIP = pip.IPAddress
+		lbHostname = publicIPFqdn(*pip)
 		fipConfigurationProperties = &network.FrontendIPConfigurationPropertiesFormat{
 			PublicIPAddress: &network.PublicIPAddress{ID: pip.ID},
 		}
@@ -237,8 +1235,12 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 		return nil, err
 	}
 	if !existsLb || lbNeedsUpdate {
+		if existsLb && !az.canModifyResource(lb.Tags, clusterName) {
+			return nil, fmt.Errorf("ensure(%s): lb(%s) - refusing to modify, not tagged for cluster %q", serviceName, lbName, clusterName)
+		}
+		lb.Tags = az.tagResourceForCluster(lb.Tags, clusterName)
 		glog.V(3).Infof("ensure(%s): lb(%s) - updating", serviceName, lbName)
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("LoadBalancerClient.CreateOrUpdate(%q): start", *lb.Name)
 		respChan, errChan := az.LoadBalancerClient.CreateOrUpdate(az.ResourceGroup, *lb.Name, lb, nil)
 		resp := <-respChan
@@ -253,47 +1255,62 @@ func (az *Cloud) EnsureLoadBalancer(clusterName string, service *v1.Service, nod
 			}
 		}
 		if err != nil {
+			if isInternal && lbIP != nil {
+				return nil, fmt.Errorf("ensure(%s): lb(%s) - failed to create or update, possibly because pinned private IP %s is already in use: %v", serviceName, lbName, *lbIP, err)
+			}
 			return nil, err
 		}
 	}
 
-	// Add the machines to the backend pool if they're not already
-	lbBackendName := getBackendPoolName(clusterName)
+	// Add the machines to the backend pool if they're not already. Only nodes belonging to
+	// the service's target pool (see resolveBackendPoolName/nodeBackendPoolName) are enrolled,
+	// so services on distinct named pools don't cross-enroll each other's nodes.
+	lbBackendName := resolveBackendPoolName(clusterName, service)
 	lbBackendPoolID := az.getBackendPoolID(lbName, lbBackendName)
-	hostUpdates := make([]func() error, len(nodes))
-	for i, node := range nodes {
+	targetNodes := filterNodesByBackendPool(nodes, clusterName, lbBackendName)
+	targetNodes = excludeMasterNodes(targetNodes, az.useStandardLoadBalancer() && az.ExcludeMasterFromStandardLB)
+	targetNodes, excludedNodes := excludeLabeledNodes(targetNodes)
+	hostUpdates := make([]func() error, 0, len(targetNodes)+len(excludedNodes))
+	for _, node := range targetNodes {
 		localNodeName := node.Name
-		f := func() error {
+		hostUpdates = append(hostUpdates, func() error {
 			err := az.ensureHostInPool(serviceName, types.NodeName(localNodeName), lbBackendPoolID)
 			if err != nil {
 				return fmt.Errorf("ensure(%s): lb(%s) - failed to ensure host in pool: %q", serviceName, lbName, err)
 			}
 			return nil
-		}
-		hostUpdates[i] = f
+		})
+	}
+	for _, node := range excludedNodes {
+		localNodeName := node.Name
+		hostUpdates = append(hostUpdates, func() error {
+			err := az.ensureHostNotInPool(serviceName, types.NodeName(localNodeName), lbBackendPoolID)
+			if err != nil {
+				return fmt.Errorf("ensure(%s): lb(%s) - failed to ensure host not in pool: %q", serviceName, lbName, err)
+			}
+			return nil
+		})
 	}
 
-	errs := utilerrors.AggregateGoroutines(hostUpdates...)
+	errs := runBounded(az.NicUpdateMaxConcurrency, hostUpdates...)
 	if errs != nil {
 		return nil, utilerrors.Flatten(errs)
 	}
 
 	glog.V(2).Infof("ensure(%s): lb(%s) finished", serviceName, lbName)
 
-	if lbIP == nil {
-		lbStatus, exists, err := az.GetLoadBalancer(clusterName, service)
+	if ipAddressPending(lbIP) {
+		lbStatus, exists, err := az.getLoadBalancerStatusForFrontend(clusterName, service, isInternal)
 		if err != nil {
 			return nil, err
 		}
 		if !exists {
 			return nil, fmt.Errorf("ensure(%s): lb(%s) - failed to get back load balancer", serviceName, lbName)
 		}
-		return lbStatus, nil
+		return &lbStatus.Ingress[0], nil
 	}
 
-	return &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{{IP: *lbIP}},
-	}, nil
+	return &v1.LoadBalancerIngress{IP: *lbIP, Hostname: lbHostname}, nil
 }
 
 // UpdateLoadBalancer updates hosts under the specified load balancer.
@@ -309,16 +1326,36 @@ func (az *Cloud) UpdateLoadBalancer(clusterName string, service *v1.Service, nod
 // have multiple underlying components, meaning a Get could say that the LB
 // doesn't exist even if some part of it is still laying around.
 func (az *Cloud) EnsureLoadBalancerDeleted(clusterName string, service *v1.Service) error {
+	err := az.ensureLoadBalancerDeleted(clusterName, service)
+	if err != nil {
+		az.recordReconcileFailure(service, err)
+	}
+	return err
+}
+
+func (az *Cloud) ensureLoadBalancerDeleted(clusterName string, service *v1.Service) error {
 	isInternal := requiresInternalLoadBalancer(service)
-	lbName := getLoadBalancerName(clusterName, isInternal)
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
+	if err != nil {
+		return err
+	}
+	lbName := getLoadBalancerName(lbBaseName, isInternal)
 	serviceName := getServiceName(service)
 
 	glog.V(5).Infof("delete(%s): START clusterName=%q lbName=%q", serviceName, clusterName, lbName)
 
-	err := az.cleanupLoadBalancer(clusterName, service, isInternal)
+	err = az.cleanupLoadBalancer(clusterName, service, isInternal)
 	if err != nil {
 		return err
 	}
+	if additionalFrontendRequested(service) {
+		// ServiceAnnotationLoadBalancerAdditionalFrontend keeps the complementary LB alive
+		// alongside the primary one (see ensureLoadBalancer); deleting the service must tear
+		// down both, not just the primary.
+		if err := az.cleanupLoadBalancer(clusterName, service, !isInternal); err != nil {
+			return err
+		}
+	}
 
 	sg, existsSg, err := az.getSecurityGroup()
 	if err != nil {
@@ -330,12 +1367,16 @@ func (az *Cloud) EnsureLoadBalancerDeleted(clusterName string, service *v1.Servi
 			return reconcileErr
 		}
 		if sgNeedsUpdate {
+			if !az.canModifyResource(sg.Tags, clusterName) {
+				return fmt.Errorf("delete(%s): sg(%s) - refusing to modify, not tagged for cluster %q", serviceName, az.SecurityGroupName, clusterName)
+			}
+			reconciledSg.Tags = az.tagResourceForCluster(sg.Tags, clusterName)
 			glog.V(3).Infof("delete(%s): sg(%s) - updating", serviceName, az.SecurityGroupName)
 			// azure-sdk-for-go introduced contraint validation which breaks the updating here if we don't set these
 			// to nil. This is a workaround until https://github.com/Azure/go-autorest/issues/112 is fixed
 			sg.SecurityGroupPropertiesFormat.NetworkInterfaces = nil
 			sg.SecurityGroupPropertiesFormat.Subnets = nil
-			az.operationPollRateLimiter.Accept()
+			az.operationPollRateLimiterWrite.Accept()
 			glog.V(10).Infof("SecurityGroupsClient.CreateOrUpdate(%q): start", *reconciledSg.Name)
 			respChan, errChan := az.SecurityGroupsClient.CreateOrUpdate(az.ResourceGroup, *reconciledSg.Name, reconciledSg, nil)
 			resp := <-respChan
@@ -352,6 +1393,7 @@ func (az *Cloud) EnsureLoadBalancerDeleted(clusterName string, service *v1.Servi
 			if err != nil {
 				return err
 			}
+			az.InvalidateCachedSecurityGroup()
 		}
 	}
 
@@ -360,7 +1402,11 @@ func (az *Cloud) EnsureLoadBalancerDeleted(clusterName string, service *v1.Servi
 }
 
 func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, isInternalLb bool) error {
-	lbName := getLoadBalancerName(clusterName, isInternalLb)
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
+	if err != nil {
+		return err
+	}
+	lbName := getLoadBalancerName(lbBaseName, isInternalLb)
 	serviceName := getServiceName(service)
 
 	glog.V(10).Infof("ensure lb deleted: clusterName=%q, serviceName=%s, lbName=%q", clusterName, serviceName, lbName)
@@ -371,10 +1417,10 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 	}
 	if existsLb {
 		var publicIPToCleanup *string
+		lbFrontendIPConfigName := getFrontendIPConfigName(service, nil)
 
 		if !isInternalLb {
 			// Find public ip resource to clean up from IP configuration
-			lbFrontendIPConfigName := getFrontendIPConfigName(service, nil)
 			for _, config := range *lb.FrontendIPConfigurations {
 				if strings.EqualFold(*config.Name, lbFrontendIPConfigName) {
 					if config.PublicIPAddress != nil {
@@ -386,14 +1432,31 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 			}
 		}
 
-		lb, lbNeedsUpdate, reconcileErr := az.reconcileLoadBalancer(lb, nil, clusterName, service, []*v1.Node{})
-		if reconcileErr != nil {
-			return reconcileErr
+		var lbNeedsUpdate bool
+		lb, lbNeedsUpdate, err = az.reconcileLoadBalancer(lb, nil, clusterName, service, []*v1.Node{})
+		if err != nil {
+			return err
+		}
+
+		if publicIPToCleanup != nil {
+			// The frontend ip configuration survived the reconcile above - some other service
+			// sharing it via ServiceAnnotationLoadBalancerSharedIP still references it - so its
+			// public IP must not be torn down along with this service.
+			for _, config := range *lb.FrontendIPConfigurations {
+				if strings.EqualFold(*config.Name, lbFrontendIPConfigName) {
+					publicIPToCleanup = nil
+					break
+				}
+			}
 		}
 		if lbNeedsUpdate {
+			if !az.canModifyResource(lb.Tags, clusterName) {
+				return fmt.Errorf("delete(%s): lb(%s) - refusing to modify, not tagged for cluster %q", serviceName, lbName, clusterName)
+			}
 			if len(*lb.FrontendIPConfigurations) > 0 {
+				lb.Tags = az.tagResourceForCluster(lb.Tags, clusterName)
 				glog.V(3).Infof("delete(%s): lb(%s) - updating", serviceName, lbName)
-				az.operationPollRateLimiter.Accept()
+				az.operationPollRateLimiterWrite.Accept()
 				glog.V(10).Infof("LoadBalancerClient.CreateOrUpdate(%q): start", *lb.Name)
 				respChan, errChan := az.LoadBalancerClient.CreateOrUpdate(az.ResourceGroup, *lb.Name, lb, nil)
 				resp := <-respChan
@@ -413,7 +1476,7 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 			} else {
 				glog.V(3).Infof("delete(%s): lb(%s) - deleting; no remaining frontendipconfigs", serviceName, lbName)
 
-				az.operationPollRateLimiter.Accept()
+				az.operationPollRateLimiterWrite.Accept()
 				glog.V(10).Infof("LoadBalancerClient.Delete(%q): start", lbName)
 				respChan, errChan := az.LoadBalancerClient.Delete(az.ResourceGroup, lbName, nil)
 				resp := <-respChan
@@ -427,7 +1490,7 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 						glog.V(2).Infof("delete(%s) abort backoff: lb(%s) - deleting; no remaining frontendipconfigs", serviceName, lbName)
 					}
 				}
-				if err != nil {
+				if err := ignoreNotFoundError(err); err != nil {
 					return err
 				}
 			}
@@ -441,7 +1504,7 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 				pipName := (*publicIPToCleanup)[index+1:]
 				if strings.EqualFold(managedPipName, pipName) {
 					glog.V(5).Infof("Deleting public IP resource %q.", pipName)
-					err = az.ensurePublicIPDeleted(serviceName, pipName)
+					err = az.ensurePublicIPDeleted(serviceName, pipName, service.Annotations[ServiceAnnotationLoadBalancerPIPResourceGroup], clusterName)
 					if err != nil {
 						return err
 					}
@@ -452,35 +1515,208 @@ func (az *Cloud) cleanupLoadBalancer(clusterName string, service *v1.Service, is
 		}
 	}
 
-	return nil
-}
+	if !isInternalLb {
+		if err := az.cleanupOrphanedPublicIPs(clusterName, service, lb); err != nil {
+			return err
+		}
+	}
+
+	if existsLb {
+		if err := az.cleanupBackendPoolNICs(clusterName, service, lb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backendPoolStillReferenced reports whether any load balancing rule on lb still targets
+// backendPoolID. cleanupLoadBalancer calls this against the load balancer as reconcile left
+// it - with this service's own rules already dropped - so a pool shared by another service's
+// surviving rules is correctly reported as still referenced, while a pool that was only ever
+// this service's (e.g. one named by ServiceAnnotationLoadBalancerBackendPool) is not.
+func backendPoolStillReferenced(lb network.LoadBalancer, backendPoolID string) bool {
+	if lb.LoadBalancingRules == nil {
+		return false
+	}
+	for _, rule := range *lb.LoadBalancingRules {
+		if rule.BackendAddressPool != nil && rule.BackendAddressPool.ID != nil &&
+			strings.EqualFold(*rule.BackendAddressPool.ID, backendPoolID) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupBackendPoolNICs removes this service's backend pool from every node NIC that still
+// carries it, once the pool is no longer referenced by any load balancing rule on lb. The
+// default cluster-wide pool is shared across every service that didn't opt into a dedicated one
+// via ServiceAnnotationLoadBalancerBackendPool, so backendPoolStillReferenced is what keeps this
+// from kicking other services' still-live nodes out of a pool they still need - it only fires
+// once this was the last service pointed at that particular pool.
+func (az *Cloud) cleanupBackendPoolNICs(clusterName string, service *v1.Service, lb network.LoadBalancer) error {
+	lbBackendPoolName := resolveBackendPoolName(clusterName, service)
+	lbBackendPoolID := az.getBackendPoolID(*lb.Name, lbBackendPoolName)
+
+	if backendPoolStillReferenced(lb, lbBackendPoolID) {
+		return nil
+	}
+
+	serviceName := getServiceName(service)
+	nodes, err := az.listAllNodesInResourceGroup()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if node.Name == nil {
+			continue
+		}
+		if err := az.ensureHostNotInPool(serviceName, mapVMNameToNodeName(*node.Name), lbBackendPoolID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// orphanedPublicIPNames returns the names of public IPs in candidates that are tagged with
+// serviceName (see ensurePublicIPExists) but that no frontend ip configuration in referencedIDs
+// references - e.g. a CreateOrUpdate that succeeded but crashed before being wired into the
+// frontend on a prior reconcile.
+func orphanedPublicIPNames(serviceName string, referencedIDs map[string]bool, candidates []network.PublicIPAddress) []string {
+	var orphaned []string
+	for _, pip := range candidates {
+		if pip.Tags == nil || pip.Name == nil {
+			continue
+		}
+		owner, tagged := (*pip.Tags)["service"]
+		if !tagged || owner == nil || *owner != serviceName {
+			continue
+		}
+		if pip.ID != nil && referencedIDs[*pip.ID] {
+			continue
+		}
+		orphaned = append(orphaned, *pip.Name)
+	}
+	return orphaned
+}
+
+// cleanupOrphanedPublicIPs deletes public IPs PublicIPAddressesClient.List reports as orphaned
+// for this service per orphanedPublicIPNames. ensurePublicIPDeleted's own canModifyResource
+// check still guards each individual delete, so a PIP claimed by a different cluster is left
+// alone even though it's never offered to ensurePublicIPDeleted in the first place here.
+func (az *Cloud) cleanupOrphanedPublicIPs(clusterName string, service *v1.Service, lb network.LoadBalancer) error {
+	serviceName := getServiceName(service)
+
+	referenced := map[string]bool{}
+	if lb.FrontendIPConfigurations != nil {
+		for _, config := range *lb.FrontendIPConfigurations {
+			if config.PublicIPAddress != nil && config.PublicIPAddress.ID != nil {
+				referenced[*config.PublicIPAddress.ID] = true
+			}
+		}
+	}
 
-func (az *Cloud) ensurePublicIPExists(serviceName, pipName string) (*network.PublicIPAddress, error) {
-	pip, existsPip, err := az.getPublicIPAddress(pipName)
+	az.operationPollRateLimiter.Accept()
+	glog.V(10).Infof("PublicIPAddressesClient.List(%v): start", az.ResourceGroup)
+	list, err := az.PublicIPAddressesClient.List(az.ResourceGroup)
+	glog.V(10).Infof("PublicIPAddressesClient.List(%v): end", az.ResourceGroup)
+	if err != nil {
+		return err
+	}
+	if list.Value == nil {
+		return nil
+	}
+
+	for _, pipName := range orphanedPublicIPNames(serviceName, referenced, *list.Value) {
+		glog.V(3).Infof("delete(%s): pip(%s) - orphaned, deleting", serviceName, pipName)
+		if err := az.ensurePublicIPDeleted(serviceName, pipName, service.Annotations[ServiceAnnotationLoadBalancerPIPResourceGroup], clusterName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (az *Cloud) ensurePublicIPExists(service *v1.Service, pipName, pipResourceGroup, clusterName string) (*network.PublicIPAddress, error) {
+	serviceName := getServiceName(service)
+	pip, existsPip, err := az.getPublicIPAddress(pipResourceGroup, pipName)
 	if err != nil {
 		return nil, err
 	}
-	if existsPip {
+
+	if _, reused := service.Annotations[ServiceAnnotationLoadBalancerPublicIPName]; reused {
+		if !existsPip {
+			return nil, fmt.Errorf("ensure(%s): pip(%s) - does not exist, refusing to create a public IP requested by name via %s", serviceName, pipName, ServiceAnnotationLoadBalancerPublicIPName)
+		}
 		return &pip, nil
 	}
 
-	pip.Name = to.StringPtr(pipName)
-	pip.Location = to.StringPtr(az.Location)
-	pip.PublicIPAddressPropertiesFormat = &network.PublicIPAddressPropertiesFormat{
-		PublicIPAllocationMethod: network.Static,
+	wantedAllocationMethod, err := resolvePIPAllocationMethod(service)
+	if err != nil {
+		return nil, err
 	}
-	pip.Tags = &map[string]*string{"service": &serviceName}
 
-	glog.V(3).Infof("ensure(%s): pip(%s) - creating", serviceName, *pip.Name)
-	az.operationPollRateLimiter.Accept()
+	dnsLabel, err := resolveDNSLabel(service)
+	if err != nil {
+		return nil, err
+	}
+
+	wantedIPVersion := resolvePublicIPAddressVersion(service)
+
+	rg := az.pipResourceGroup(pipResourceGroup)
+
+	if existsPip {
+		if publicIPAddressVersionMismatch(pip, wantedIPVersion) {
+			return nil, fmt.Errorf("ensure(%s): pip(%s) - has IP version %q, cannot switch to %q via %s without deleting and recreating the public IP", serviceName, pipName, pip.PublicIPAddressPropertiesFormat.PublicIPAddressVersion, wantedIPVersion, ServiceAnnotationLoadBalancerIPv6)
+		}
+		updatedPip, allocationChanged := applyPIPAllocationMethod(pip, wantedAllocationMethod)
+		updatedPip, dnsLabelChanged := applyDNSLabel(updatedPip, dnsLabel)
+		if !allocationChanged && !dnsLabelChanged {
+			return &pip, nil
+		}
+		if !az.canModifyResource(pip.Tags, clusterName) {
+			return nil, fmt.Errorf("ensure(%s): pip(%s) - refusing to modify, not tagged for cluster %q", serviceName, pipName, clusterName)
+		}
+		glog.V(3).Infof("ensure(%s): pip(%s) - updating allocation method and/or DNS label", serviceName, pipName)
+		// CreateOrUpdate in place: deleting and recreating would hand back a different address.
+		pip = updatedPip
+	} else {
+		reverseFqdn, err := resolvePIPReverseFqdn(service)
+		if err != nil {
+			return nil, err
+		}
+
+		pip.Name = to.StringPtr(pipName)
+		pip.Location = to.StringPtr(az.Location)
+		pip.PublicIPAddressPropertiesFormat = &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: wantedAllocationMethod,
+			PublicIPAddressVersion:   wantedIPVersion,
+		}
+		if reverseFqdn != "" || dnsLabel != "" {
+			pip.PublicIPAddressPropertiesFormat.DNSSettings = &network.PublicIPAddressDNSSettings{}
+			if reverseFqdn != "" {
+				pip.DNSSettings.ReverseFqdn = to.StringPtr(reverseFqdn)
+			}
+			if dnsLabel != "" {
+				pip.DNSSettings.DomainNameLabel = to.StringPtr(dnsLabel)
+			}
+		}
+		pip.Tags = az.tagResourceForCluster(&map[string]*string{"service": &serviceName}, clusterName)
+
+		glog.V(3).Infof("ensure(%s): pip(%s) - creating", serviceName, *pip.Name)
+	}
+
+	az.operationPollRateLimiterWrite.Accept()
 	glog.V(10).Infof("PublicIPAddressesClient.CreateOrUpdate(%q): start", *pip.Name)
-	respChan, errChan := az.PublicIPAddressesClient.CreateOrUpdate(az.ResourceGroup, *pip.Name, pip, nil)
+	respChan, errChan := az.PublicIPAddressesClient.CreateOrUpdate(rg, *pip.Name, pip, nil)
 	resp := <-respChan
 	err = <-errChan
 	glog.V(10).Infof("PublicIPAddressesClient.CreateOrUpdate(%q): end", *pip.Name)
 	if az.CloudProviderBackoff && shouldRetryAPIRequest(resp.Response, err) {
 		glog.V(2).Infof("ensure(%s) backing off: pip(%s) - creating", serviceName, *pip.Name)
-		retryErr := az.CreateOrUpdatePIPWithRetry(pip)
+		retryErr := az.CreateOrUpdatePIPWithRetry(rg, pip)
 		if retryErr != nil {
 			glog.V(2).Infof("ensure(%s) abort backoff: pip(%s) - creating", serviceName, *pip.Name)
 			err = retryErr
@@ -492,7 +1728,7 @@ func (az *Cloud) ensurePublicIPExists(serviceName, pipName string) (*network.Pub
 
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("PublicIPAddressesClient.Get(%q): start", *pip.Name)
-	pip, err = az.PublicIPAddressesClient.Get(az.ResourceGroup, *pip.Name, "")
+	pip, err = az.PublicIPAddressesClient.Get(rg, *pip.Name, "")
 	glog.V(10).Infof("PublicIPAddressesClient.Get(%q): end", *pip.Name)
 	if err != nil {
 		return nil, err
@@ -502,26 +1738,35 @@ func (az *Cloud) ensurePublicIPExists(serviceName, pipName string) (*network.Pub
 
 }
 
-func (az *Cloud) ensurePublicIPDeleted(serviceName, pipName string) error {
-	glog.V(2).Infof("ensure(%s): pip(%s) - deleting", serviceName, pipName)
-	az.operationPollRateLimiter.Accept()
-	glog.V(10).Infof("PublicIPAddressesClient.Delete(%q): start", pipName)
-	resp, deleteErrChan := az.PublicIPAddressesClient.Delete(az.ResourceGroup, pipName, nil)
-	deleteErr := <-deleteErrChan
-	glog.V(10).Infof("PublicIPAddressesClient.Delete(%q): end", pipName) // response not read yet...
-	if az.CloudProviderBackoff && shouldRetryAPIRequest(<-resp, deleteErr) {
-		glog.V(2).Infof("ensure(%s) backing off: pip(%s) - deleting", serviceName, pipName)
-		retryErr := az.DeletePublicIPWithRetry(pipName)
-		if retryErr != nil {
-			glog.V(2).Infof("ensure(%s) abort backoff: pip(%s) - deleting", serviceName, pipName)
-			return retryErr
-		}
+func (az *Cloud) ensurePublicIPDeleted(serviceName, pipName, pipResourceGroup, clusterName string) error {
+	rg := az.pipResourceGroup(pipResourceGroup)
+	pip, existsPip, err := az.getPublicIPAddress(pipResourceGroup, pipName)
+	if err != nil {
+		return err
 	}
-	_, realErr := checkResourceExistsFromError(deleteErr)
-	if realErr != nil {
-		return nil
+	if existsPip && !az.canModifyResource(pip.Tags, clusterName) {
+		return fmt.Errorf("ensure(%s): pip(%s) - refusing to delete, not tagged for cluster %q", serviceName, pipName, clusterName)
 	}
-	return nil
+	glog.V(2).Infof("ensure(%s): pip(%s) - deleting", serviceName, pipName)
+	deleteErr := deletePublicIPWithInUseRetry(func() error {
+		az.operationPollRateLimiterWrite.Accept()
+		glog.V(10).Infof("PublicIPAddressesClient.Delete(%q): start", pipName)
+		resp, deleteErrChan := az.PublicIPAddressesClient.Delete(rg, pipName, nil)
+		deleteErr := <-deleteErrChan
+		glog.V(10).Infof("PublicIPAddressesClient.Delete(%q): end", pipName) // response not read yet...
+		if az.CloudProviderBackoff && shouldRetryAPIRequest(<-resp, deleteErr) {
+			glog.V(2).Infof("ensure(%s) backing off: pip(%s) - deleting", serviceName, pipName)
+			retryErr := az.DeletePublicIPWithRetry(rg, pipName)
+			if retryErr != nil {
+				glog.V(2).Infof("ensure(%s) abort backoff: pip(%s) - deleting", serviceName, pipName)
+				return retryErr
+			}
+			return nil
+		}
+		return deleteErr
+	}, pipDeleteInUseRetryAttempts, func() { time.Sleep(pipDeleteInUseRetryInterval) })
+
+	return ignoreNotFoundError(deleteErr)
 }
 
 // This ensures load balancer exists and the frontend ip config is setup.
@@ -529,16 +1774,53 @@ func (az *Cloud) ensurePublicIPDeleted(serviceName, pipName string) error {
 // This entails adding rules/probes for expected Ports and removing stale rules/ports.
 func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfigurationProperties *network.FrontendIPConfigurationPropertiesFormat, clusterName string, service *v1.Service, nodes []*v1.Node) (network.LoadBalancer, bool, error) {
 	isInternal := requiresInternalLoadBalancer(service)
-	lbName := getLoadBalancerName(clusterName, isInternal)
+	lbBaseName, err := resolveLoadBalancerBaseName(clusterName, service)
+	if err != nil {
+		return lb, false, err
+	}
+	lbName := getLoadBalancerName(lbBaseName, isInternal)
 	serviceName := getServiceName(service)
 	lbFrontendIPConfigName := getFrontendIPConfigName(service, subnet(service))
 	lbFrontendIPConfigID := az.getFrontendIPConfigID(lbName, lbFrontendIPConfigName)
-	lbBackendPoolName := getBackendPoolName(clusterName)
+	lbBackendPoolName := resolveBackendPoolName(clusterName, service)
 	lbBackendPoolID := az.getBackendPoolID(lbName, lbBackendPoolName)
 
+	if _, err := loadBalancerSkuName(az.LoadBalancerSku); err != nil {
+		return lb, false, err
+	}
+	if err := az.ensureSubnetNatGatewayEgress(); err != nil {
+		return lb, false, err
+	}
+
 	wantLb := fipConfigurationProperties != nil
 	dirtyLb := false
 
+	// update probes/rules
+	var ports []v1.ServicePort
+	if wantLb {
+		ports = service.Spec.Ports
+	} else {
+		ports = []v1.ServicePort{}
+	}
+
+	// A shared LB frontend (e.g. two services pinned to the same loadBalancerIP) can leave
+	// this service wanting a frontend+port another service's rule already occupies; Azure
+	// rejects that outright, so check for it up front against the policy configured via
+	// LoadBalancerFrontendPortConflictPolicy rather than letting the API call fail.
+	if wantLb && lb.LoadBalancingRules != nil {
+		for _, port := range ports {
+			if conflictingRule, conflict := findFrontendPortConflict(*lb.LoadBalancingRules, service, lbFrontendIPConfigID, port.Port); conflict {
+				if frontendPortConflictPolicy(az.LoadBalancerFrontendPortConflictPolicy) == loadBalancerFrontendPortConflictPolicyReassign {
+					glog.V(3).Infof("reconcile(%s)(%t): lb frontendconfig(%s) port %d conflicts with rule %q - reassigning to a dedicated frontend", serviceName, wantLb, lbFrontendIPConfigName, port.Port, conflictingRule)
+					lbFrontendIPConfigName = fmt.Sprintf("%s-%s", lbFrontendIPConfigName, MakeCRC32(serviceName))
+					lbFrontendIPConfigID = az.getFrontendIPConfigID(lbName, lbFrontendIPConfigName)
+					break
+				}
+				return lb, false, fmt.Errorf("service %s cannot use frontend %q port %d: already in use by rule %q", serviceName, lbFrontendIPConfigName, port.Port, conflictingRule)
+			}
+		}
+	}
+
 	// Ensure LoadBalancer's Backend Pool Configuration
 	if wantLb {
 		newBackendPools := []network.BackendAddressPool{}
@@ -576,11 +1858,16 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 	if !wantLb {
 		for i := len(newConfigs) - 1; i >= 0; i-- {
 			config := newConfigs[i]
-			if serviceOwnsFrontendIP(config, service) {
-				glog.V(3).Infof("reconcile(%s)(%t): lb frontendconfig(%s) - dropping", serviceName, wantLb, lbFrontendIPConfigName)
-				newConfigs = append(newConfigs[:i], newConfigs[i+1:]...)
-				dirtyConfigs = true
+			if !serviceOwnsFrontendIP(config, service) {
+				continue
 			}
+			if az.frontendIPConfigInUseByOtherService(lb, service, az.getFrontendIPConfigID(lbName, *config.Name)) {
+				glog.V(3).Infof("reconcile(%s)(%t): lb frontendconfig(%s) - still shared by another service, keeping", serviceName, wantLb, *config.Name)
+				continue
+			}
+			glog.V(3).Infof("reconcile(%s)(%t): lb frontendconfig(%s) - dropping", serviceName, wantLb, lbFrontendIPConfigName)
+			newConfigs = append(newConfigs[:i], newConfigs[i+1:]...)
+			dirtyConfigs = true
 		}
 	} else {
 		if isInternal {
@@ -603,7 +1890,7 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 		if !foundConfig {
 			newConfigs = append(newConfigs,
 				network.FrontendIPConfiguration{
-					Name: to.StringPtr(lbFrontendIPConfigName),
+					Name:                                    to.StringPtr(lbFrontendIPConfigName),
 					FrontendIPConfigurationPropertiesFormat: fipConfigurationProperties,
 				})
 			glog.V(10).Infof("reconcile(%s)(%t): lb frontendconfig(%s) - adding", serviceName, wantLb, lbFrontendIPConfigName)
@@ -615,12 +1902,31 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 		lb.FrontendIPConfigurations = &newConfigs
 	}
 
-	// update probes/rules
-	var ports []v1.ServicePort
+	if wantLb && isInternal {
+		if disable, ok := service.Annotations[ServiceAnnotationLoadBalancerDisableOutboundSNAT]; ok && disable != "" {
+			// DisableOutboundSnat only has an effect on a Standard SKU load balancer, which
+			// this vendored Azure SDK snapshot doesn't model (no Sku field on LoadBalancer,
+			// no DisableOutboundSnat field on LoadBalancingRulePropertiesFormat). Fail loudly
+			// rather than silently accepting an annotation we can't honor.
+			return lb, false, fmt.Errorf("%s is not supported: this cloud provider build only supports Basic SKU load balancers", ServiceAnnotationLoadBalancerDisableOutboundSNAT)
+		}
+	}
+
 	if wantLb {
-		ports = service.Spec.Ports
-	} else {
-		ports = []v1.ServicePort{}
+		if enable, ok := service.Annotations[ServiceAnnotationLoadBalancerEnableOutboundSNAT]; ok && enable != "" {
+			// An explicit outbound rule is only meaningful for a Standard SKU load balancer
+			// (see ServiceAnnotationLoadBalancerEnableOutboundSNAT); this provider build only
+			// supports Basic SKU, where the frontend already gives backends implicit outbound
+			// connectivity. Fail loudly rather than silently accepting an annotation we can't
+			// honor.
+			return lb, false, fmt.Errorf("%s is not supported: this cloud provider build only supports Basic SKU load balancers", ServiceAnnotationLoadBalancerEnableOutboundSNAT)
+		}
+	}
+
+	sharedProbe := sharedProbeEnabled(service)
+	sharedProbeName := ""
+	if sharedProbe {
+		sharedProbeName = resolveSharedProbeName(service, ports)
 	}
 
 	var expectedProbes []network.Probe
@@ -628,42 +1934,45 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 	for _, port := range ports {
 		lbRuleName := getLoadBalancerRuleName(service, port, subnet(service))
 
-		transportProto, _, probeProto, err := getProtocolsFromKubernetesProtocol(port.Protocol)
+		transportProto, _, probeProto, err := getProtocolsFromKubernetesProtocol(port.Protocol, az.useStandardLoadBalancer())
 		if err != nil {
 			return lb, false, err
 		}
 
-		if serviceapi.NeedsHealthCheck(service) {
-			if port.Protocol == v1.ProtocolUDP {
-				// ERROR: this isn't supported
-				// health check (aka source ip preservation) is not
-				// compatible with UDP (it uses an HTTP check)
-				return lb, false, fmt.Errorf("services requiring health checks are incompatible with UDP ports")
-			}
-
-			podPresencePath, podPresencePort := serviceapi.GetServiceHealthCheckPathPort(service)
+		if serviceapi.NeedsHealthCheck(service) && port.Protocol == v1.ProtocolUDP {
+			// ERROR: this isn't supported
+			// health check (aka source ip preservation) is not
+			// compatible with UDP (it uses an HTTP check)
+			return lb, false, fmt.Errorf("services requiring health checks are incompatible with UDP ports")
+		}
 
-			expectedProbes = append(expectedProbes, network.Probe{
-				Name: &lbRuleName,
-				ProbePropertiesFormat: &network.ProbePropertiesFormat{
-					RequestPath:       to.StringPtr(podPresencePath),
-					Protocol:          network.ProbeProtocolHTTP,
-					Port:              to.Int32Ptr(podPresencePort),
-					IntervalInSeconds: to.Int32Ptr(5),
-					NumberOfProbes:    to.Int32Ptr(2),
-				},
-			})
-		} else if port.Protocol != v1.ProtocolUDP {
-			// we only add the expected probe if we're doing TCP
-			expectedProbes = append(expectedProbes, network.Probe{
-				Name: &lbRuleName,
+		probeCfg, err := az.resolveProbeConfig(service, port, probeProto)
+		if err != nil {
+			return lb, false, err
+		}
+		if probeCfg != nil && (!sharedProbe || lbRuleName == sharedProbeName) {
+			probeName := lbRuleName
+			probeProtocol := probeCfg.Protocol
+			probePort := probeCfg.Port
+			probeRequestPath := probeCfg.RequestPath
+			if sharedProbe {
+				probeName = sharedProbeName
+				probeProtocol = network.ProbeProtocolTCP
+				probeRequestPath = ""
+			}
+			probe := network.Probe{
+				Name: &probeName,
 				ProbePropertiesFormat: &network.ProbePropertiesFormat{
-					Protocol:          *probeProto,
-					Port:              to.Int32Ptr(port.NodePort),
-					IntervalInSeconds: to.Int32Ptr(5),
-					NumberOfProbes:    to.Int32Ptr(2),
+					Protocol:          probeProtocol,
+					Port:              to.Int32Ptr(probePort),
+					IntervalInSeconds: to.Int32Ptr(probeCfg.IntervalInSeconds),
+					NumberOfProbes:    to.Int32Ptr(probeCfg.NumberOfProbes),
 				},
-			})
+			}
+			if probeRequestPath != "" {
+				probe.RequestPath = to.StringPtr(probeRequestPath)
+			}
+			expectedProbes = append(expectedProbes, probe)
 		}
 
 		loadDistribution := network.Default
@@ -671,27 +1980,56 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 			loadDistribution = network.SourceIP
 		}
 
+		idleTimeout, err := resolveLoadBalancerRuleIdleTimeout(service)
+		if err != nil {
+			return lb, false, err
+		}
+
+		enableFloatingIP := floatingIPEnabled(service)
+		backendPort := port.NodePort
+		if enableFloatingIP {
+			// Floating IP (Direct Server Return) has the backend see the frontend's own
+			// destination IP/port, so the backend must listen on the frontend port rather
+			// than its NodePort.
+			backendPort = port.Port
+		}
+		backendPort, err = resolveBackendPort(service, backendPort)
+		if err != nil {
+			return lb, false, err
+		}
+
+		ruleProto, err := resolveLoadBalancerRuleProtocol(service, *transportProto)
+		if err != nil {
+			return lb, false, err
+		}
+
 		expectedRule := network.LoadBalancingRule{
 			Name: &lbRuleName,
 			LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
-				Protocol: *transportProto,
+				Protocol: ruleProto,
 				FrontendIPConfiguration: &network.SubResource{
 					ID: to.StringPtr(lbFrontendIPConfigID),
 				},
 				BackendAddressPool: &network.SubResource{
 					ID: to.StringPtr(lbBackendPoolID),
 				},
-				LoadDistribution: loadDistribution,
-				FrontendPort:     to.Int32Ptr(port.Port),
-				BackendPort:      to.Int32Ptr(port.Port),
-				EnableFloatingIP: to.BoolPtr(true),
+				LoadDistribution:     loadDistribution,
+				FrontendPort:         to.Int32Ptr(port.Port),
+				BackendPort:          to.Int32Ptr(backendPort),
+				EnableFloatingIP:     to.BoolPtr(enableFloatingIP),
+				IdleTimeoutInMinutes: to.Int32Ptr(idleTimeout),
 			},
 		}
 
-		// we didn't construct the probe objects for UDP because they're not used/needed/allowed
-		if port.Protocol != v1.ProtocolUDP {
+		// UDP rules only get a probe reference when ServiceAnnotationLoadBalancerUDPHealthProbePort
+		// opted this port into Tcp probing - Azure has no way to probe a UDP rule directly.
+		if probeCfg != nil {
+			probeName := lbRuleName
+			if sharedProbe {
+				probeName = sharedProbeName
+			}
 			expectedRule.Probe = &network.SubResource{
-				ID: to.StringPtr(az.getLoadBalancerProbeID(lbName, lbRuleName)),
+				ID: to.StringPtr(az.getLoadBalancerProbeID(lbName, probeName)),
 			}
 		}
 
@@ -704,6 +2042,10 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 	if lb.Probes != nil {
 		updatedProbes = *lb.Probes
 	}
+	probesBeforeRemoval := make(map[string]bool)
+	for _, probe := range updatedProbes {
+		probesBeforeRemoval[*probe.Name] = true
+	}
 	for i := len(updatedProbes) - 1; i >= 0; i-- {
 		existingProbe := updatedProbes[i]
 		if serviceOwnsRule(service, *existingProbe.Name) {
@@ -754,6 +2096,13 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 				glog.V(10).Infof("reconcile(%s)(%t): lb rule(%s) - keeping", serviceName, wantLb, *existingRule.Name)
 				keepRule = true
 			}
+			if !keepRule && stagedRemovalEnabled(service) && probesBeforeRemoval[*existingRule.Name] {
+				// first reconcile after removal: the probe above just stopped routing new
+				// traffic to it, but leave the rule itself for one more reconcile so
+				// in-flight connections aren't cut immediately.
+				glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - staging removal, keeping rule for one more reconcile", serviceName, wantLb, *existingRule.Name)
+				keepRule = true
+			}
 			if !keepRule {
 				glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - dropping", serviceName, wantLb, *existingRule.Name)
 				updatedRules = append(updatedRules[:i], updatedRules[i+1:]...)
@@ -761,12 +2110,29 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 			}
 		}
 	}
-	// update rules: add needed
+	// update rules: add needed, or update in place if a mutable field (e.g. idle timeout) changed
 	for _, expectedRule := range expectedRules {
 		foundRule := false
-		if findRule(updatedRules, expectedRule) {
-			glog.V(10).Infof("reconcile(%s)(%t): lb rule(%s) - already exists", serviceName, wantLb, *expectedRule.Name)
-			foundRule = true
+		for i := range updatedRules {
+			if strings.EqualFold(*updatedRules[i].Name, *expectedRule.Name) {
+				foundRule = true
+				if to.Int32(updatedRules[i].IdleTimeoutInMinutes) != to.Int32(expectedRule.IdleTimeoutInMinutes) {
+					glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - updating idle timeout", serviceName, wantLb, *expectedRule.Name)
+					updatedRules[i] = expectedRule
+					dirtyRules = true
+				} else if updatedRules[i].LoadDistribution != expectedRule.LoadDistribution {
+					glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - updating load distribution to %s", serviceName, wantLb, *expectedRule.Name, expectedRule.LoadDistribution)
+					updatedRules[i] = expectedRule
+					dirtyRules = true
+				} else if updatedRules[i].Protocol != expectedRule.Protocol {
+					glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - updating protocol to %s", serviceName, wantLb, *expectedRule.Name, expectedRule.Protocol)
+					updatedRules[i] = expectedRule
+					dirtyRules = true
+				} else {
+					glog.V(10).Infof("reconcile(%s)(%t): lb rule(%s) - already exists", serviceName, wantLb, *expectedRule.Name)
+				}
+				break
+			}
 		}
 		if !foundRule {
 			glog.V(10).Infof("reconcile(%s)(%t): lb rule(%s) adding", serviceName, wantLb, *expectedRule.Name)
@@ -779,11 +2145,228 @@ func (az *Cloud) reconcileLoadBalancer(lb network.LoadBalancer, fipConfiguration
 		lb.LoadBalancingRules = &updatedRules
 	}
 
+	// drop any rule whose FrontendIPConfiguration reference no longer exists: Azure rejects
+	// the LB write outright if a rule dangles off a removed frontend (e.g. after a frontend
+	// IP config was dropped above, or changed out from under us between reconciles).
+	existingFrontendNames := make(map[string]bool)
+	for _, config := range newConfigs {
+		if config.Name != nil {
+			existingFrontendNames[*config.Name] = true
+		}
+	}
+	for i := len(updatedRules) - 1; i >= 0; i-- {
+		rule := updatedRules[i]
+		if rule.FrontendIPConfiguration == nil || rule.FrontendIPConfiguration.ID == nil {
+			continue
+		}
+		frontendName, err := getLastSegment(*rule.FrontendIPConfiguration.ID)
+		if err != nil {
+			continue
+		}
+		if !existingFrontendNames[frontendName] {
+			glog.V(3).Infof("reconcile(%s)(%t): lb rule(%s) - dropping, frontend no longer exists", serviceName, wantLb, *rule.Name)
+			updatedRules = append(updatedRules[:i], updatedRules[i+1:]...)
+			dirtyRules = true
+		}
+	}
+	if dirtyRules {
+		dirtyLb = true
+		lb.LoadBalancingRules = &updatedRules
+	}
+
+	// clean up any probes left behind by protocol/port churn: a probe may have
+	// survived the per-port reconciliation above (e.g. because it was created
+	// under a now-stale name) but no rule in the final rule set references it
+	// any longer.
+	referencedProbes := make(map[string]bool)
+	for _, rule := range updatedRules {
+		referencedProbes[*rule.Name] = true
+	}
+	for i := len(updatedProbes) - 1; i >= 0; i-- {
+		existingProbe := updatedProbes[i]
+		if serviceOwnsRule(service, *existingProbe.Name) && !referencedProbes[*existingProbe.Name] {
+			glog.V(10).Infof("reconcile(%s)(%t): lb probe(%s) - orphaned, dropping", serviceName, wantLb, *existingProbe.Name)
+			updatedProbes = append(updatedProbes[:i], updatedProbes[i+1:]...)
+			dirtyProbes = true
+		}
+	}
+	if dirtyProbes {
+		dirtyLb = true
+		lb.Probes = &updatedProbes
+	}
+
 	return lb, dirtyLb, nil
 }
 
+// LoadBalancerDiff summarizes the named rules, probes, and frontend IP configurations
+// ReconcileLoadBalancerDryRun would add or remove, so a caller doesn't need to diff
+// network.LoadBalancer's nested slices itself to see what a reconcile would change.
+type LoadBalancerDiff struct {
+	RulesAdded, RulesRemoved             []string
+	ProbesAdded, ProbesRemoved           []string
+	FrontendIPsAdded, FrontendIPsRemoved []string
+}
+
+func loadBalancingRuleNames(lb network.LoadBalancer) []string {
+	var names []string
+	if lb.LoadBalancingRules != nil {
+		for _, rule := range *lb.LoadBalancingRules {
+			names = append(names, to.String(rule.Name))
+		}
+	}
+	return names
+}
+
+func probeNames(lb network.LoadBalancer) []string {
+	var names []string
+	if lb.Probes != nil {
+		for _, probe := range *lb.Probes {
+			names = append(names, to.String(probe.Name))
+		}
+	}
+	return names
+}
+
+func frontendIPConfigNames(lb network.LoadBalancer) []string {
+	var names []string
+	if lb.FrontendIPConfigurations != nil {
+		for _, fip := range *lb.FrontendIPConfigurations {
+			names = append(names, to.String(fip.Name))
+		}
+	}
+	return names
+}
+
+// diffNames reports which names in after aren't in before (added) and which in before aren't in
+// after (removed).
+func diffNames(before, after []string) (added, removed []string) {
+	beforeSet := make(map[string]bool, len(before))
+	for _, name := range before {
+		beforeSet[name] = true
+	}
+	afterSet := make(map[string]bool, len(after))
+	for _, name := range after {
+		afterSet[name] = true
+		if !beforeSet[name] {
+			added = append(added, name)
+		}
+	}
+	for _, name := range before {
+		if !afterSet[name] {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// ReconcileLoadBalancerDryRun computes the network.LoadBalancer reconcileLoadBalancer would
+// produce for service, plus a LoadBalancerDiff of what it would add or remove, without
+// invoking any client calls. reconcileLoadBalancer already only builds the desired LoadBalancer
+// in memory - EnsureLoadBalancer is what actually calls LoadBalancerClient.CreateOrUpdate with
+// the result - so this exists purely to let a caller (e.g. a cluster-migration preview tool)
+// get a structured summary of the churn instead of diffing the raw rule/probe/frontend slices
+// itself. The returned LoadBalancer is exactly what reconcileLoadBalancer returned; callers that
+// only care about validateLoadBalancer-style assertions can use it directly.
+func (az *Cloud) ReconcileLoadBalancerDryRun(lb network.LoadBalancer, fipConfigurationProperties *network.FrontendIPConfigurationPropertiesFormat, clusterName string, service *v1.Service, nodes []*v1.Node) (network.LoadBalancer, LoadBalancerDiff, error) {
+	rulesBefore := loadBalancingRuleNames(lb)
+	probesBefore := probeNames(lb)
+	frontendsBefore := frontendIPConfigNames(lb)
+
+	updatedLb, _, err := az.reconcileLoadBalancer(lb, fipConfigurationProperties, clusterName, service, nodes)
+	if err != nil {
+		return updatedLb, LoadBalancerDiff{}, err
+	}
+
+	var diff LoadBalancerDiff
+	diff.RulesAdded, diff.RulesRemoved = diffNames(rulesBefore, loadBalancingRuleNames(updatedLb))
+	diff.ProbesAdded, diff.ProbesRemoved = diffNames(probesBefore, probeNames(updatedLb))
+	diff.FrontendIPsAdded, diff.FrontendIPsRemoved = diffNames(frontendsBefore, frontendIPConfigNames(updatedLb))
+	return updatedLb, diff, nil
+}
+
+// rulePrefixPattern matches the literal rule-name prefix this provider generates (see
+// getRulePrefix/cloudprovider.GetLoadBalancerName): the letter "a" followed by a service UID
+// with its dashes stripped, then the "-" that separates the prefix from protocol/port/subnet. A
+// rule added by hand through the portal essentially never collides with this.
+var rulePrefixPattern = regexp.MustCompile(`^a[0-9a-fA-F]+-`)
+
+// matchesRuleNamingScheme reports whether name looks like one this provider could have generated,
+// as opposed to a rule some other actor (e.g. a portal edit) added directly to the resource.
+func matchesRuleNamingScheme(name string) bool {
+	return rulePrefixPattern.MatchString(name)
+}
+
+// ownedRulePrefixes returns the set of rule-name prefixes (see getRulePrefix) belonging to
+// liveServices, so a prefix absent from this set - despite matching matchesRuleNamingScheme -
+// identifies a rule left behind by a service that no longer exists.
+func ownedRulePrefixes(liveServices []v1.Service) map[string]bool {
+	prefixes := make(map[string]bool, len(liveServices))
+	for i := range liveServices {
+		prefixes[strings.ToUpper(getRulePrefix(&liveServices[i]))] = true
+	}
+	return prefixes
+}
+
+// isOrphanedRuleName reports whether name matches this provider's naming scheme but its prefix
+// doesn't belong to any service in liveServices - i.e. the service that owned it is gone, and
+// normal per-service reconcile (which only ever evicts rules owned by the one service it's
+// reconciling) will never clean it up on its own.
+func isOrphanedRuleName(name string, owned map[string]bool) bool {
+	if !matchesRuleNamingScheme(name) {
+		return false
+	}
+	prefix := name[:strings.Index(name, "-")]
+	return !owned[strings.ToUpper(prefix)]
+}
+
+// PruneStaleLoadBalancerRules removes LoadBalancingRules and Probes whose name matches this
+// provider's naming scheme but no longer corresponds to any service in liveServices, leaving
+// rules that don't match the naming scheme (e.g. added by hand in the Azure portal) untouched.
+// Per-service reconcile (reconcileLoadBalancer) only ever evicts rules owned by the single
+// service it's reconciling, so it can't detect a rule left behind by a service that was deleted
+// entirely - callers with a full view of live services (e.g. a periodic GC pass driven by a
+// service lister, which this per-service cloudprovider.Interface implementation does not itself
+// have access to) should call this explicitly rather than relying on EnsureLoadBalancer to do it.
+func PruneStaleLoadBalancerRules(lb network.LoadBalancer, liveServices []v1.Service) (network.LoadBalancer, bool) {
+	owned := ownedRulePrefixes(liveServices)
+	dirty := false
+
+	if lb.LoadBalancingRules != nil {
+		var kept []network.LoadBalancingRule
+		for _, rule := range *lb.LoadBalancingRules {
+			if isOrphanedRuleName(to.String(rule.Name), owned) {
+				dirty = true
+				continue
+			}
+			kept = append(kept, rule)
+		}
+		lb.LoadBalancingRules = &kept
+	}
+
+	if lb.Probes != nil {
+		var kept []network.Probe
+		for _, probe := range *lb.Probes {
+			if isOrphanedRuleName(to.String(probe.Name), owned) {
+				dirty = true
+				continue
+			}
+			kept = append(kept, probe)
+		}
+		lb.Probes = &kept
+	}
+
+	return lb, dirty
+}
+
 // This reconciles the Network Security Group similar to how the LB is reconciled.
 // This entails adding required, missing SecurityRules and removing stale rules.
+//
+// reconcileSecurityGroup only ever adds to or removes from sg.SecurityRules - it never deletes
+// the NSG itself (it doesn't even have a reference to SecurityGroupsClient to do so) and never
+// touches any other field, including Subnets/NetworkInterfaces association. Even reconciling away
+// a service's very last rule just leaves sg with an empty SecurityRules slice; the shared NSG
+// resource, and whatever it's attached to, is always left for the caller to CreateOrUpdate, never
+// to Delete.
 func (az *Cloud) reconcileSecurityGroup(sg network.SecurityGroup, clusterName string, service *v1.Service, wantLb bool) (network.SecurityGroup, bool, error) {
 	serviceName := getServiceName(service)
 	var ports []v1.ServicePort
@@ -797,26 +2380,59 @@ func (az *Cloud) reconcileSecurityGroup(sg network.SecurityGroup, clusterName st
 	if err != nil {
 		return sg, false, err
 	}
+	// A service with many LoadBalancerSourceRanges still gets one allow rule per CIDR below,
+	// rather than a single rule listing all of them via SecurityRulePropertiesFormat's plural
+	// SourceAddressPrefixes - this vendored SDK predates that field, exposing only the
+	// singular SourceAddressPrefix (see vendor/.../arm/network/models.go). getSharedSecurityRuleName
+	// at least keeps identical-source rules deduplicated across services, but a single
+	// many-CIDR service still consumes one priority slot per range; SecurityRuleMaximum is the
+	// only backstop against exhausting them until this tree's SDK is updated.
 	var sourceAddressPrefixes []string
 	if sourceRanges == nil || serviceapi.IsAllowAll(sourceRanges) {
 		if !requiresInternalLoadBalancer(service) {
 			sourceAddressPrefixes = []string{"Internet"}
+		} else if internalAllowsBroadSource(service) {
+			sourceAddressPrefixes = []string{"Internet"}
+		} else {
+			sourceAddressPrefixes = []string{virtualNetworkSourceTag}
 		}
 	} else {
 		for _, ip := range sourceRanges {
 			sourceAddressPrefixes = append(sourceAddressPrefixes, ip.String())
 		}
 	}
+	// Restrictive source ranges lock the NSG down to the caller's CIDRs, which also blocks
+	// the load balancer's own health probes. Always allow the AzureLoadBalancer service tag
+	// in that case so nodes don't get marked unhealthy. The VirtualNetwork default for
+	// internal services isn't a caller-specified restriction in that sense - probes within
+	// the vnet are already covered by it - so it doesn't need the tag or fail-closed rule.
+	needsAzureLoadBalancerTag := len(sourceAddressPrefixes) > 0 &&
+		!stringSliceContains(sourceAddressPrefixes, "Internet") &&
+		!stringSliceContains(sourceAddressPrefixes, virtualNetworkSourceTag)
+
 	expectedSecurityRules := make([]network.SecurityRule, len(ports)*len(sourceAddressPrefixes))
 
+	// reservedBandRules seeds priority allocation for the AzureLoadBalancer-tag allow rule and
+	// the fail-closed deny rule below: it starts as sg's actual existing rules, so two services
+	// sharing this NSG each get a distinct priority within the reserved band instead of both
+	// defaulting to <base>+<their own per-service port index>, and grows as this call claims
+	// priorities so multiple ports on the same service don't collide with each other either.
+	var reservedBandRules []network.SecurityRule
+	if sg.SecurityRules != nil {
+		reservedBandRules = append(reservedBandRules, (*sg.SecurityRules)...)
+	}
+
 	for i, port := range ports {
-		_, securityProto, _, err := getProtocolsFromKubernetesProtocol(port.Protocol)
+		_, securityProto, _, err := getProtocolsFromKubernetesProtocol(port.Protocol, az.useStandardLoadBalancer())
 		if err != nil {
 			return sg, false, err
 		}
 		for j := range sourceAddressPrefixes {
 			ix := i*len(sourceAddressPrefixes) + j
-			securityRuleName := getSecurityRuleName(service, port, sourceAddressPrefixes[j])
+			// Named independently of the service so that two services wanting the identical
+			// protocol/port/source rule share one NSG entry; Description tracks which
+			// services currently need it (see addServiceToSharedSecurityRule).
+			securityRuleName := getSharedSecurityRuleName(port, sourceAddressPrefixes[j])
 			expectedSecurityRules[ix] = network.SecurityRule{
 				Name: to.StringPtr(securityRuleName),
 				SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
@@ -825,10 +2441,79 @@ func (az *Cloud) reconcileSecurityGroup(sg network.SecurityGroup, clusterName st
 					DestinationPortRange:     to.StringPtr(strconv.Itoa(int(port.Port))),
 					SourceAddressPrefix:      to.StringPtr(sourceAddressPrefixes[j]),
 					DestinationAddressPrefix: to.StringPtr("*"),
-					Access:    network.SecurityRuleAccessAllow,
-					Direction: network.SecurityRuleDirectionInbound,
+					Access:                   network.SecurityRuleAccessAllow,
+					Direction:                network.SecurityRuleDirectionInbound,
+					Description:              to.StringPtr(serviceName),
+				},
+			}
+		}
+		if needsAzureLoadBalancerTag {
+			tagPriority, err := getNextAvailablePriority(to.String(sg.Name), reservedBandRules, azureLoadBalancerTagRulePriorityBase, loadBalancerMinimumPriority)
+			if err != nil {
+				return sg, false, err
+			}
+			ruleName := getSecurityRuleName(service, port, azureLoadBalancerSourceTag)
+			tagRule := network.SecurityRule{
+				Name: to.StringPtr(ruleName),
+				SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+					Protocol:                 *securityProto,
+					SourcePortRange:          to.StringPtr("*"),
+					DestinationPortRange:     to.StringPtr(strconv.Itoa(int(port.Port))),
+					SourceAddressPrefix:      to.StringPtr(azureLoadBalancerSourceTag),
+					DestinationAddressPrefix: to.StringPtr("*"),
+					Access:                   network.SecurityRuleAccessAllow,
+					Direction:                network.SecurityRuleDirectionInbound,
+					Priority:                 to.Int32Ptr(tagPriority),
+					Description:              to.StringPtr(serviceName),
+				},
+			}
+			expectedSecurityRules = append(expectedSecurityRules, tagRule)
+			reservedBandRules = append(reservedBandRules, tagRule)
+
+			// Explicitly deny everything else on this port. NSGs already default-deny at
+			// their lowest priority, but that rule isn't provider-owned, so a service's
+			// failure-closed guarantee shouldn't depend on a user never adding a broader
+			// allow rule below it; this rule is added/removed with the restriction itself.
+			denyPriority, err := getNextAvailablePriority(to.String(sg.Name), reservedBandRules, azureLoadBalancerDenyAllRulePriorityBase, loadBalancerMaximumPriority)
+			if err != nil {
+				return sg, false, err
+			}
+			denyRuleName := getSecurityRuleName(service, port, azureLoadBalancerDenyAllSourceAddressPrefix)
+			denyRule := network.SecurityRule{
+				Name: to.StringPtr(denyRuleName),
+				SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+					Protocol:                 *securityProto,
+					SourcePortRange:          to.StringPtr("*"),
+					DestinationPortRange:     to.StringPtr(strconv.Itoa(int(port.Port))),
+					SourceAddressPrefix:      to.StringPtr("*"),
+					DestinationAddressPrefix: to.StringPtr("*"),
+					Access:                   network.SecurityRuleAccessDeny,
+					Direction:                network.SecurityRuleDirectionInbound,
+					Priority:                 to.Int32Ptr(denyPriority),
+					Description:              to.StringPtr(serviceName),
 				},
 			}
+			expectedSecurityRules = append(expectedSecurityRules, denyRule)
+			reservedBandRules = append(reservedBandRules, denyRule)
+		}
+	}
+
+	if wantLb {
+		if healthCheckPort, needsRule := healthCheckNodePortRule(service); needsRule {
+			ruleName := getSecurityRuleName(service, healthCheckPort, azureLoadBalancerSourceTag)
+			expectedSecurityRules = append(expectedSecurityRules, network.SecurityRule{
+				Name: to.StringPtr(ruleName),
+				SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+					Protocol:                 network.SecurityRuleProtocolTCP,
+					SourcePortRange:          to.StringPtr("*"),
+					DestinationPortRange:     to.StringPtr(strconv.Itoa(int(healthCheckPort.Port))),
+					SourceAddressPrefix:      to.StringPtr(azureLoadBalancerSourceTag),
+					DestinationAddressPrefix: to.StringPtr("*"),
+					Access:                   network.SecurityRuleAccessAllow,
+					Direction:                network.SecurityRuleDirectionInbound,
+					Description:              to.StringPtr(serviceName),
+				},
+			})
 		}
 	}
 
@@ -838,9 +2523,48 @@ func (az *Cloud) reconcileSecurityGroup(sg network.SecurityGroup, clusterName st
 	if sg.SecurityRules != nil {
 		updatedRules = *sg.SecurityRules
 	}
+	// update security rules: remove rules left behind by a deleted-and-recreated service.
+	// getRulePrefix embeds the service UID, so serviceOwnsRule alone won't recognize a rule
+	// created under the service's previous UID; Description instead carries the stable
+	// namespace/name, so it's used here to catch rules the current UID-based prefix misses.
+	for i := len(updatedRules) - 1; i >= 0; i-- {
+		existingRule := updatedRules[i]
+		if isSharedSecurityRuleName(to.String(existingRule.Name)) {
+			// A shared rule's name doesn't embed a service UID, so it can't go stale this
+			// way; its lifecycle is entirely refcount-driven below.
+			continue
+		}
+		if serviceOwnsRule(service, to.String(existingRule.Name)) {
+			continue
+		}
+		if to.String(existingRule.Description) == serviceName {
+			glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - dropping stale rule from a previous service UID", serviceName, wantLb, to.String(existingRule.Name))
+			updatedRules = append(updatedRules[:i], updatedRules[i+1:]...)
+			dirtySg = true
+		}
+	}
 	// update security rules: remove unwanted
 	for i := len(updatedRules) - 1; i >= 0; i-- {
 		existingRule := updatedRules[i]
+		if isSharedSecurityRuleName(to.String(existingRule.Name)) {
+			if !sharedSecurityRuleReferencesService(existingRule, serviceName) {
+				continue
+			}
+			if findSecurityRule(expectedSecurityRules, existingRule) {
+				glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - keeping shared rule", serviceName, wantLb, *existingRule.Name)
+				continue
+			}
+			glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - dropping this service's reference to a shared rule", serviceName, wantLb, *existingRule.Name)
+			updatedRule, refcountZero := removeServiceFromSharedSecurityRule(existingRule, serviceName)
+			if refcountZero {
+				glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - last referencing service gone, dropping", serviceName, wantLb, *existingRule.Name)
+				updatedRules = append(updatedRules[:i], updatedRules[i+1:]...)
+			} else {
+				updatedRules[i] = updatedRule
+			}
+			dirtySg = true
+			continue
+		}
 		if serviceOwnsRule(service, *existingRule.Name) {
 			glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - considering evicting", serviceName, wantLb, *existingRule.Name)
 			keepRule := false
@@ -861,31 +2585,141 @@ func (az *Cloud) reconcileSecurityGroup(sg network.SecurityGroup, clusterName st
 		if findSecurityRule(updatedRules, expectedRule) {
 			glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - already exists", serviceName, wantLb, *expectedRule.Name)
 			foundRule = true
+			if isSharedSecurityRuleName(*expectedRule.Name) {
+				for i, existingRule := range updatedRules {
+					if !strings.EqualFold(to.String(existingRule.Name), *expectedRule.Name) {
+						continue
+					}
+					if !sharedSecurityRuleReferencesService(existingRule, serviceName) {
+						glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - adding this service to an existing shared rule", serviceName, wantLb, *expectedRule.Name)
+						updatedRules[i] = addServiceToSharedSecurityRule(existingRule, serviceName)
+						dirtySg = true
+					}
+					break
+				}
+			}
 		}
 		if !foundRule {
 			glog.V(10).Infof("reconcile(%s)(%t): sg rule(%s) - adding", serviceName, wantLb, *expectedRule.Name)
 
-			nextAvailablePriority, err := getNextAvailablePriority(updatedRules)
-			if err != nil {
-				return sg, false, err
+			if expectedRule.Priority == nil {
+				nextAvailablePriority, err := getNextAvailablePriority(to.String(sg.Name), updatedRules, loadBalancerMinimumPriority, loadBalancerMaximumPriority)
+				if err != nil {
+					return sg, false, err
+				}
+				expectedRule.Priority = to.Int32Ptr(nextAvailablePriority)
 			}
-
-			expectedRule.Priority = to.Int32Ptr(nextAvailablePriority)
 			updatedRules = append(updatedRules, expectedRule)
 			dirtySg = true
 		}
 	}
 	if dirtySg {
+		maximum := securityRuleMaximum(az.SecurityRuleMaximum)
+		if len(updatedRules) > maximum {
+			return sg, false, fmt.Errorf("reconciling security group %s for service %s would exceed the maximum of %d rules (have %d): consolidate rules (e.g. fewer ports per service, or shared LoadBalancerSourceRanges) or raise SecurityRuleMaximum", to.String(sg.Name), serviceName, maximum, len(updatedRules))
+		}
 		sg.SecurityRules = &updatedRules
 	}
 	return sg, dirtySg, nil
 }
 
+// validateSecurityGroupRules computes the rule set reconcileSecurityGroup would produce for
+// the given service and diffs it against sg's existing provider-owned rules, without mutating
+// sg or writing anything. It's for clusters that keep a curated "golden" NSG and want drift
+// from the provider's desired state surfaced rather than silently overwritten.
+func (az *Cloud) validateSecurityGroupRules(sg network.SecurityGroup, clusterName string, service *v1.Service, wantLb bool) error {
+	before := ruleNamesOwnedByService(sg, service)
+
+	// reconcileSecurityGroup writes through sg.SecurityGroupPropertiesFormat, which is a
+	// shared pointer the caller also holds; clone it so this validate-only pass can't mutate
+	// the golden NSG the caller passed in.
+	reconciled, dirty, err := az.reconcileSecurityGroup(cloneSecurityGroup(sg), clusterName, service, wantLb)
+	if err != nil {
+		return err
+	}
+	if !dirty {
+		return nil
+	}
+
+	after := ruleNamesOwnedByService(reconciled, service)
+	var added, removed []string
+	for name := range after {
+		if !before[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range before {
+		if !after[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	return fmt.Errorf("securityGroup %q has drifted from the rules %q expects: would add %v, would remove %v", to.String(sg.Name), getServiceName(service), added, removed)
+}
+
+func cloneSecurityGroup(sg network.SecurityGroup) network.SecurityGroup {
+	if sg.SecurityGroupPropertiesFormat == nil {
+		return sg
+	}
+	propsCopy := *sg.SecurityGroupPropertiesFormat
+	if sg.SecurityRules != nil {
+		rulesCopy := make([]network.SecurityRule, len(*sg.SecurityRules))
+		copy(rulesCopy, *sg.SecurityRules)
+		// network.SecurityRule embeds *SecurityRulePropertiesFormat by pointer, so the
+		// copy above still aliases each original rule's properties. Give every rule its
+		// own properties struct too, or a write through one clone's rule (e.g. the shared-
+		// rule Description rewrites in addServiceToSharedSecurityRule) would still mutate
+		// the original sg's rule out from under its caller.
+		for i, rule := range rulesCopy {
+			if rule.SecurityRulePropertiesFormat != nil {
+				ruleProps := *rule.SecurityRulePropertiesFormat
+				rulesCopy[i].SecurityRulePropertiesFormat = &ruleProps
+			}
+		}
+		propsCopy.SecurityRules = &rulesCopy
+	}
+	sg.SecurityGroupPropertiesFormat = &propsCopy
+	return sg
+}
+
+func ruleNamesOwnedByService(sg network.SecurityGroup, service *v1.Service) map[string]bool {
+	names := make(map[string]bool)
+	if sg.SecurityRules == nil {
+		return names
+	}
+	serviceName := getServiceName(service)
+	for _, rule := range *sg.SecurityRules {
+		if serviceOwnsRule(service, *rule.Name) {
+			names[*rule.Name] = true
+			continue
+		}
+		if isSharedSecurityRuleName(to.String(rule.Name)) && sharedSecurityRuleReferencesService(rule, serviceName) {
+			names[*rule.Name] = true
+		}
+	}
+	return names
+}
+
+// findProbe reports whether probes already contains an entry equivalent to
+// probe. Unlike findRule/findSecurityRule, the probe name alone doesn't
+// uniquely determine its configuration (e.g. switching a service between
+// externalTrafficPolicy Cluster and Local keeps the same probe name but
+// changes its protocol and port), so the probe's properties are compared too.
 func findProbe(probes []network.Probe, probe network.Probe) bool {
 	for _, existingProbe := range probes {
-		if strings.EqualFold(*existingProbe.Name, *probe.Name) {
-			return true
+		if !strings.EqualFold(*existingProbe.Name, *probe.Name) {
+			continue
 		}
+		if existingProbe.Protocol != probe.Protocol {
+			continue
+		}
+		if to.Int32(existingProbe.Port) != to.Int32(probe.Port) {
+			continue
+		}
+		if to.String(existingProbe.RequestPath) != to.String(probe.RequestPath) {
+			continue
+		}
+		return true
 	}
 	return false
 }
@@ -908,9 +2742,120 @@ func findSecurityRule(rules []network.SecurityRule, rule network.SecurityRule) b
 	return false
 }
 
+// backendPoolEnrollmentStrategy resolves the configured backend pool enrollment strategy,
+// defaulting to NIC IP configuration enrollment when unset.
+func backendPoolEnrollmentStrategy(configured string) string {
+	if configured == loadBalancerBackendPoolConfigurationTypeNodeVM {
+		return loadBalancerBackendPoolConfigurationTypeNodeVM
+	}
+	return loadBalancerBackendPoolConfigurationTypeNodeIPConfiguration
+}
+
+// sharedProbeEnabled reports whether ServiceAnnotationLoadBalancerSharedProbe requests
+// consolidating a service's per-port probes into a single shared Tcp probe. Never honored for
+// services needing externalTrafficPolicy: Local health checks, which already share one probe.
+func sharedProbeEnabled(service *v1.Service) bool {
+	if serviceapi.NeedsHealthCheck(service) {
+		return false
+	}
+	shared, ok := service.Annotations[ServiceAnnotationLoadBalancerSharedProbe]
+	return ok && shared == "true"
+}
+
+// resolveSharedProbeName returns the name of the shared probe sharedProbeEnabled's rules
+// should reference: the rule name of the service's first non-UDP port, since Udp ports have
+// no probe at all. Returns "" if there's no such port to anchor it on.
+func resolveSharedProbeName(service *v1.Service, ports []v1.ServicePort) string {
+	for _, port := range ports {
+		if port.Protocol != v1.ProtocolUDP {
+			return getLoadBalancerRuleName(service, port, subnet(service))
+		}
+	}
+	return ""
+}
+
+// frontendPortConflictPolicy resolves the configured frontend/port conflict policy,
+// defaulting to Error when unset or unrecognized.
+func frontendPortConflictPolicy(configured string) string {
+	if strings.EqualFold(configured, loadBalancerFrontendPortConflictPolicyReassign) {
+		return loadBalancerFrontendPortConflictPolicyReassign
+	}
+	return loadBalancerFrontendPortConflictPolicyError
+}
+
+const (
+	// loadBalancerSkuBasic is the default SKU used for load balancers and public IPs this
+	// provider creates.
+	loadBalancerSkuBasic = "basic"
+	// loadBalancerSkuStandard selects the Standard SKU, which supports more than 100 backend
+	// instances and availability-zone redundancy.
+	loadBalancerSkuStandard = "standard"
+)
+
+// loadBalancerSkuName validates and normalizes the configured LoadBalancerSku value, defaulting
+// to Basic when unset. Standard is rejected rather than silently falling back to Basic: this
+// vendored version of network.LoadBalancer and network.PublicIPAddress has no Sku field, so
+// there is no way for this provider to actually create a Standard SKU resource, and a request
+// for one must fail loudly instead of landing on a SKU the caller didn't ask for. This is one of
+// the tracked SDK-gap rejections listed in Config's doc comment, not a partial implementation.
+func loadBalancerSkuName(configured string) (string, error) {
+	if configured == "" || strings.EqualFold(configured, loadBalancerSkuBasic) {
+		return loadBalancerSkuBasic, nil
+	}
+	if strings.EqualFold(configured, loadBalancerSkuStandard) {
+		return "", fmt.Errorf("LoadBalancerSku %q is not supported by this provider build: the vendored Azure SDK's network.LoadBalancer and network.PublicIPAddress types have no Sku field to set", configured)
+	}
+	return "", fmt.Errorf("unsupported LoadBalancerSku %q: must be %q or %q", configured, loadBalancerSkuBasic, loadBalancerSkuStandard)
+}
+
+// useStandardLoadBalancer reports whether the configured LoadBalancerSku is Standard, gating
+// behavior that only makes sense for (or only is safe with) that SKU, such as
+// ExcludeMasterFromStandardLB and the Basic-only single-availability-set backend pool
+// restriction in ensureHostInPool.
+func (az *Cloud) useStandardLoadBalancer() bool {
+	return strings.EqualFold(az.LoadBalancerSku, loadBalancerSkuStandard)
+}
+
+// ensureSubnetNatGatewayEgress rejects EnableNatGatewayEgress outright rather than silently
+// ignoring it: see the field's doc comment in Config for why this provider build cannot
+// associate a NAT gateway with a subnet at all. Like loadBalancerSkuName, this is checked on
+// every reconcile so a misconfigured cluster fails loudly instead of quietly keeping its old
+// LB-outbound-SNAT egress behavior. This is one of the tracked SDK-gap rejections listed in
+// Config's doc comment, not a partial implementation.
+func (az *Cloud) ensureSubnetNatGatewayEgress() error {
+	if !az.EnableNatGatewayEgress {
+		return nil
+	}
+	return fmt.Errorf("enableNatGatewayEgress is not supported by this provider build: the vendored Azure SDK predates NAT gateway entirely (network.Subnet has no NatGateway field, and there is no NAT gateway client type), and this provider never calls SubnetsClient.CreateOrUpdate - subnets are treated as externally managed and only ever read, never written")
+}
+
+// findFrontendPortConflict reports the name of an existing rule owned by a different
+// service that already occupies the given frontend IP configuration ID and port, if any.
+// Azure rejects two rules with different names sharing the same frontend+port, so this
+// must be checked before merging a new rule in, rather than relying on the eventual API
+// error to surface it.
+func findFrontendPortConflict(rules []network.LoadBalancingRule, service *v1.Service, frontendIPConfigID string, port int32) (string, bool) {
+	for _, rule := range rules {
+		if rule.Name == nil || serviceOwnsRule(service, *rule.Name) {
+			continue
+		}
+		if rule.FrontendIPConfiguration == nil || rule.FrontendIPConfiguration.ID == nil ||
+			!strings.EqualFold(*rule.FrontendIPConfiguration.ID, frontendIPConfigID) {
+			continue
+		}
+		if to.Int32(rule.FrontendPort) == port {
+			return *rule.Name, true
+		}
+	}
+	return "", false
+}
+
 // This ensures the given VM's Primary NIC's Primary IP Configuration is
 // participating in the specified LoadBalancer Backend Pool.
 func (az *Cloud) ensureHostInPool(serviceName string, nodeName types.NodeName, backendPoolID string) error {
+	if backendPoolEnrollmentStrategy(az.LoadBalancerBackendPoolConfigurationType) == loadBalancerBackendPoolConfigurationTypeNodeVM {
+		return fmt.Errorf("loadBalancerBackendPoolConfigurationType %q is not supported: this cloud provider build can only enroll nodes into the backend pool by NIC IP configuration", loadBalancerBackendPoolConfigurationTypeNodeVM)
+	}
 	var machine compute.VirtualMachine
 	vmName := mapNodeNameToVMName(nodeName)
 	az.operationPollRateLimiter.Accept()
@@ -939,8 +2884,12 @@ func (az *Cloud) ensureHostInPool(serviceName string, nodeName types.NodeName, b
 		return err
 	}
 
-	// Check availability set
-	if az.PrimaryAvailabilitySetName != "" {
+	// Basic SKU load balancers can only reference backend pool members from a single
+	// availability set, so nodes outside PrimaryAvailabilitySetName are skipped rather than
+	// sent to the API, where they'd fail. Standard SKU has no such restriction, so a cluster
+	// spreading nodes across multiple availability sets needs useStandardLoadBalancer to enroll
+	// all of them.
+	if !az.useStandardLoadBalancer() && az.PrimaryAvailabilitySetName != "" {
 		expectedAvailabilitySetName := az.getAvailabilitySetID(az.PrimaryAvailabilitySetName)
 		if machine.AvailabilitySet == nil || !strings.EqualFold(*machine.AvailabilitySet.ID, expectedAvailabilitySetName) {
 			glog.V(3).Infof(
@@ -984,7 +2933,7 @@ func (az *Cloud) ensureHostInPool(serviceName string, nodeName types.NodeName, b
 		primaryIPConfig.LoadBalancerBackendAddressPools = &newBackendPools
 
 		glog.V(3).Infof("nicupdate(%s): nic(%s) - updating", serviceName, nicName)
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("InterfacesClient.CreateOrUpdate(%q): start", *nic.Name)
 		respChan, errChan := az.InterfacesClient.CreateOrUpdate(az.ResourceGroup, *nic.Name, nic, nil)
 		resp := <-respChan
@@ -1005,6 +2954,95 @@ func (az *Cloud) ensureHostInPool(serviceName string, nodeName types.NodeName, b
 	return nil
 }
 
+// nicWithoutBackendPool returns a copy of pools with backendPoolID removed, and whether it was
+// actually present, so callers can skip a no-op CreateOrUpdate. Every other pool reference is
+// carried over untouched, since a NIC can belong to more than one backend pool at once (e.g. a
+// dedicated pool from ServiceAnnotationLoadBalancerBackendPool alongside the default one).
+func nicWithoutBackendPool(pools []network.BackendAddressPool, backendPoolID string) ([]network.BackendAddressPool, bool) {
+	remaining := make([]network.BackendAddressPool, 0, len(pools))
+	removed := false
+	for _, pool := range pools {
+		if pool.ID != nil && strings.EqualFold(*pool.ID, backendPoolID) {
+			removed = true
+			continue
+		}
+		remaining = append(remaining, pool)
+	}
+	return remaining, removed
+}
+
+// ensureHostNotInPool removes the given node's primary NIC from the specified LoadBalancer
+// Backend Pool, the mirror image of ensureHostInPool. It is a no-op, without calling
+// InterfacesClient.CreateOrUpdate, if the NIC is not currently a member of backendPoolID.
+func (az *Cloud) ensureHostNotInPool(serviceName string, nodeName types.NodeName, backendPoolID string) error {
+	vmName := mapNodeNameToVMName(nodeName)
+	az.operationPollRateLimiter.Accept()
+	glog.V(10).Infof("VirtualMachinesClient.Get(%q): start", vmName)
+	machine, err := az.VirtualMachinesClient.Get(az.ResourceGroup, vmName, "")
+	glog.V(10).Infof("VirtualMachinesClient.Get(%q): end", vmName)
+	if err != nil {
+		if az.CloudProviderBackoff {
+			glog.V(2).Infof("ensureHostNotInPool(%s, %s, %s) backing off", serviceName, nodeName, backendPoolID)
+			machine, err = az.VirtualMachineClientGetWithRetry(az.ResourceGroup, vmName, "")
+			if err != nil {
+				glog.V(2).Infof("ensureHostNotInPool(%s, %s, %s) abort backoff", serviceName, nodeName, backendPoolID)
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	primaryNicID, err := getPrimaryInterfaceID(machine)
+	if err != nil {
+		return err
+	}
+	nicName, err := getLastSegment(primaryNicID)
+	if err != nil {
+		return err
+	}
+
+	az.operationPollRateLimiter.Accept()
+	glog.V(10).Infof("InterfacesClient.Get(%q): start", nicName)
+	nic, err := az.InterfacesClient.Get(az.ResourceGroup, nicName, "")
+	glog.V(10).Infof("InterfacesClient.Get(%q): end", nicName)
+	if err != nil {
+		return err
+	}
+
+	primaryIPConfig, err := getPrimaryIPConfig(nic)
+	if err != nil {
+		return err
+	}
+
+	existingPools := []network.BackendAddressPool{}
+	if primaryIPConfig.LoadBalancerBackendAddressPools != nil {
+		existingPools = *primaryIPConfig.LoadBalancerBackendAddressPools
+	}
+	remainingPools, removed := nicWithoutBackendPool(existingPools, backendPoolID)
+	if !removed {
+		return nil
+	}
+	primaryIPConfig.LoadBalancerBackendAddressPools = &remainingPools
+
+	glog.V(3).Infof("nicupdate(%s): nic(%s) - removing from backend pool %s", serviceName, nicName, backendPoolID)
+	az.operationPollRateLimiterWrite.Accept()
+	glog.V(10).Infof("InterfacesClient.CreateOrUpdate(%q): start", *nic.Name)
+	respChan, errChan := az.InterfacesClient.CreateOrUpdate(az.ResourceGroup, *nic.Name, nic, nil)
+	resp := <-respChan
+	err = <-errChan
+	glog.V(10).Infof("InterfacesClient.CreateOrUpdate(%q): end", *nic.Name)
+	if az.CloudProviderBackoff && shouldRetryAPIRequest(resp.Response, err) {
+		glog.V(2).Infof("nicupdate(%s) backing off: nic(%s) - removing from backend pool, err=%v", serviceName, nicName, err)
+		retryErr := az.CreateOrUpdateInterfaceWithRetry(nic)
+		if retryErr != nil {
+			err = retryErr
+			glog.V(2).Infof("nicupdate(%s) abort backoff: nic(%s) - removing from backend pool", serviceName, nicName)
+		}
+	}
+	return err
+}
+
 // Check if service requires an internal load balancer.
 func requiresInternalLoadBalancer(service *v1.Service) bool {
 	if l, ok := service.Annotations[ServiceAnnotationLoadBalancerInternal]; ok {
@@ -1023,3 +3061,33 @@ func subnet(service *v1.Service) *string {
 
 	return nil
 }
+
+// resolveInternalLoadBalancerIP returns the private IP to pin an internal load balancer's
+// frontend IP configuration to. Spec.LoadBalancerIP, the generic Kubernetes mechanism, takes
+// precedence; ServiceAnnotationLoadBalancerInternalIP is the fallback for services that already
+// use Spec.LoadBalancerIP for something else. Returns "" if neither is set, in which case Azure
+// auto-assigns a dynamic address.
+func resolveInternalLoadBalancerIP(service *v1.Service) string {
+	if service.Spec.LoadBalancerIP != "" {
+		return service.Spec.LoadBalancerIP
+	}
+	return service.Annotations[ServiceAnnotationLoadBalancerInternalIP]
+}
+
+// validateInternalLoadBalancerIP checks that ip is a valid address falling inside subnetCIDR,
+// so a misconfigured pinned IP fails fast at reconcile time with a clear reason instead of
+// surfacing later as an opaque CreateOrUpdate failure.
+func validateInternalLoadBalancerIP(ip string, subnetCIDR string) error {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return fmt.Errorf("%q is not a valid IP address", ip)
+	}
+	_, ipNet, err := net.ParseCIDR(subnetCIDR)
+	if err != nil {
+		return fmt.Errorf("failed to parse subnet CIDR %q: %v", subnetCIDR, err)
+	}
+	if !ipNet.Contains(parsedIP) {
+		return fmt.Errorf("%q does not fall inside subnet CIDR %q", ip, subnetCIDR)
+	}
+	return nil
+}
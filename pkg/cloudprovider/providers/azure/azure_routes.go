@@ -77,9 +77,9 @@ func (az *Cloud) CreateRoute(clusterName string, nameHint string, kubeRoute *clo
 		}
 
 		glog.V(3).Infof("create: creating routetable. routeTableName=%q", az.RouteTableName)
-		az.operationPollRateLimiter.Accept()
+		az.operationPollRateLimiterWrite.Accept()
 		glog.V(10).Infof("RouteTablesClient.CreateOrUpdate(%q): start", az.RouteTableName)
-		respChan, errChan := az.RouteTablesClient.CreateOrUpdate(az.ResourceGroup, az.RouteTableName, routeTable, nil)
+		respChan, errChan := az.RouteTablesClient.CreateOrUpdate(az.routeTableResourceGroup(), az.RouteTableName, routeTable, nil)
 		resp := <-respChan
 		err := <-errChan
 		glog.V(10).Infof("RouteTablesClient.CreateOrUpdate(%q): end", az.RouteTableName)
@@ -96,7 +96,7 @@ func (az *Cloud) CreateRoute(clusterName string, nameHint string, kubeRoute *clo
 		}
 
 		glog.V(10).Infof("RouteTablesClient.Get(%q): start", az.RouteTableName)
-		routeTable, err = az.RouteTablesClient.Get(az.ResourceGroup, az.RouteTableName, "")
+		routeTable, err = az.RouteTablesClient.Get(az.routeTableResourceGroup(), az.RouteTableName, "")
 		glog.V(10).Infof("RouteTablesClient.Get(%q): end", az.RouteTableName)
 		if err != nil {
 			return err
@@ -119,9 +119,9 @@ func (az *Cloud) CreateRoute(clusterName string, nameHint string, kubeRoute *clo
 	}
 
 	glog.V(3).Infof("create: creating route: instance=%q cidr=%q", kubeRoute.TargetNode, kubeRoute.DestinationCIDR)
-	az.operationPollRateLimiter.Accept()
+	az.operationPollRateLimiterWrite.Accept()
 	glog.V(10).Infof("RoutesClient.CreateOrUpdate(%q): start", az.RouteTableName)
-	respChan, errChan := az.RoutesClient.CreateOrUpdate(az.ResourceGroup, az.RouteTableName, *route.Name, route, nil)
+	respChan, errChan := az.RoutesClient.CreateOrUpdate(az.routeTableResourceGroup(), az.RouteTableName, *route.Name, route, nil)
 	resp := <-respChan
 	err = <-errChan
 	glog.V(10).Infof("RoutesClient.CreateOrUpdate(%q): end", az.RouteTableName)
@@ -147,9 +147,9 @@ func (az *Cloud) DeleteRoute(clusterName string, kubeRoute *cloudprovider.Route)
 	glog.V(2).Infof("delete: deleting route. clusterName=%q instance=%q cidr=%q", clusterName, kubeRoute.TargetNode, kubeRoute.DestinationCIDR)
 
 	routeName := mapNodeNameToRouteName(kubeRoute.TargetNode)
-	az.operationPollRateLimiter.Accept()
+	az.operationPollRateLimiterWrite.Accept()
 	glog.V(10).Infof("RoutesClient.Delete(%q): start", az.RouteTableName)
-	respChan, errChan := az.RoutesClient.Delete(az.ResourceGroup, az.RouteTableName, routeName, nil)
+	respChan, errChan := az.RoutesClient.Delete(az.routeTableResourceGroup(), az.RouteTableName, routeName, nil)
 	resp := <-respChan
 	err := <-errChan
 	glog.V(10).Infof("RoutesClient.Delete(%q): end", az.RouteTableName)
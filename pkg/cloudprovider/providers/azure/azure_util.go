@@ -29,6 +29,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -127,9 +128,18 @@ func getLastSegment(ID string) (string, error) {
 	return name, nil
 }
 
+// protocolSCTP is v1.ProtocolSCTP's value. This vendored k8s.io/api/core/v1 predates SCTP as a
+// Kubernetes service protocol, so there's no v1.ProtocolSCTP constant to reference - this is the
+// literal string Kubernetes later settled on, matched by value instead.
+const protocolSCTP v1.Protocol = "SCTP"
+
 // returns the equivalent LoadBalancerRule, SecurityRule and LoadBalancerProbe
-// protocol types for the given Kubernetes protocol type.
-func getProtocolsFromKubernetesProtocol(protocol v1.Protocol) (*network.TransportProtocol, *network.SecurityRuleProtocol, *network.ProbeProtocol, error) {
+// protocol types for the given Kubernetes protocol type. useStandardSku gates SCTP, which Azure
+// only ever supported on Standard SKU load balancers - moot in practice, since
+// loadBalancerSkuName already rejects Standard outright for lacking a Sku field to set, so
+// useStandardSku is always false here today, but the gate is kept explicit rather than baked in
+// so this doesn't silently start claiming SCTP support the day Standard SKU does become available.
+func getProtocolsFromKubernetesProtocol(protocol v1.Protocol, useStandardSku bool) (*network.TransportProtocol, *network.SecurityRuleProtocol, *network.ProbeProtocol, error) {
 	var transportProto network.TransportProtocol
 	var securityProto network.SecurityRuleProtocol
 	var probeProto network.ProbeProtocol
@@ -144,6 +154,14 @@ func getProtocolsFromKubernetesProtocol(protocol v1.Protocol) (*network.Transpor
 		transportProto = network.TransportProtocolUDP
 		securityProto = network.SecurityRuleProtocolUDP
 		return &transportProto, &securityProto, nil, nil
+	case protocolSCTP:
+		if !useStandardSku {
+			return nil, nil, nil, fmt.Errorf("unsupported protocol %s: SCTP requires a Standard SKU load balancer, and this provider build cannot create one (see loadBalancerSkuName)", protocol)
+		}
+		// Even on Standard SKU, this vendored Azure SDK predates SCTP entirely: neither
+		// network.TransportProtocol nor network.SecurityRuleProtocol has an SCTP value to
+		// return here, so there is still nothing valid to hand back.
+		return nil, nil, nil, fmt.Errorf("unsupported protocol %s: the vendored Azure SDK has no SCTP transport or security-rule protocol value", protocol)
 	default:
 		return &transportProto, &securityProto, &probeProto, fmt.Errorf("Only TCP and UDP are supported for Azure LoadBalancers")
 	}
@@ -152,31 +170,41 @@ func getProtocolsFromKubernetesProtocol(protocol v1.Protocol) (*network.Transpor
 
 // This returns the full identifier of the primary NIC for the given VM.
 func getPrimaryInterfaceID(machine compute.VirtualMachine) (string, error) {
-	if len(*machine.NetworkProfile.NetworkInterfaces) == 1 {
-		return *(*machine.NetworkProfile.NetworkInterfaces)[0].ID, nil
+	nics := *machine.NetworkProfile.NetworkInterfaces
+	if len(nics) == 1 {
+		return *nics[0].ID, nil
 	}
 
-	for _, ref := range *machine.NetworkProfile.NetworkInterfaces {
-		if *ref.Primary {
+	for _, ref := range nics {
+		if ref.NetworkInterfaceReferenceProperties != nil && to.Bool(ref.Primary) {
 			return *ref.ID, nil
 		}
 	}
 
-	return "", fmt.Errorf("failed to find a primary nic for the vm. vmname=%q", *machine.Name)
+	// A multi-NIC VM with none of its NICs flagged primary (e.g. an older API version, or a
+	// caller that never set it) - fall back to the first NIC rather than failing outright,
+	// instead of risking attaching the load balancer backend pool to whichever NIC happens to
+	// be listed last (e.g. an accelerated-networking NIC on a GPU node).
+	glog.Warningf("failed to find a primary nic for the vm %q among %d NICs; falling back to the first one", *machine.Name, len(nics))
+	return *nics[0].ID, nil
 }
 
 func getPrimaryIPConfig(nic network.Interface) (*network.InterfaceIPConfiguration, error) {
-	if len(*nic.IPConfigurations) == 1 {
-		return &((*nic.IPConfigurations)[0]), nil
+	configs := *nic.IPConfigurations
+	if len(configs) == 1 {
+		return &configs[0], nil
 	}
 
-	for _, ref := range *nic.IPConfigurations {
-		if *ref.Primary {
+	for _, ref := range configs {
+		if ref.InterfaceIPConfigurationPropertiesFormat != nil && to.Bool(ref.Primary) {
 			return &ref, nil
 		}
 	}
 
-	return nil, fmt.Errorf("failed to determine the determine primary ipconfig. nicname=%q", *nic.Name)
+	// Same reasoning as getPrimaryInterfaceID's fallback: an IP configuration that's never had
+	// Primary explicitly set shouldn't make an otherwise-healthy NIC unusable.
+	glog.Warningf("failed to find a primary ipconfig for nic %q among %d ipconfigs; falling back to the first one", *nic.Name, len(configs))
+	return &configs[0], nil
 }
 
 // For a load balancer, all frontend ip should reference either a subnet or publicIpAddress.
@@ -195,11 +223,27 @@ func getBackendPoolName(clusterName string) string {
 	return clusterName
 }
 
+// loadBalancerRuleNameMaxLength is Azure's resource name length limit, which a long subnet
+// name appended to the (already UID-bounded) load balancer rule prefix can exceed.
+const loadBalancerRuleNameMaxLength = 80
+
 func getLoadBalancerRuleName(service *v1.Service, port v1.ServicePort, subnetName *string) string {
+	prefix := getRulePrefix(service)
 	if subnetName == nil {
-		return fmt.Sprintf("%s-%s-%d", getRulePrefix(service), port.Protocol, port.Port)
+		return fmt.Sprintf("%s-%s-%d", prefix, port.Protocol, port.Port)
+	}
+	name := fmt.Sprintf("%s-%s-%s-%d", prefix, *subnetName, port.Protocol, port.Port)
+	if len(name) <= loadBalancerRuleNameMaxLength {
+		return name
 	}
-	return fmt.Sprintf("%s-%s-%s-%d", getRulePrefix(service), *subnetName, port.Protocol, port.Port)
+	// The full name doesn't fit: fold the subnet name down to a short, stable hash instead of
+	// truncating it outright, so distinct long subnet names don't collide and the resulting
+	// name stays the same across reconciles.
+	hashed := fmt.Sprintf("%s-%s-%s-%d", prefix, MakeCRC32(*subnetName), port.Protocol, port.Port)
+	if len(hashed) > loadBalancerRuleNameMaxLength {
+		hashed = hashed[:loadBalancerRuleNameMaxLength]
+	}
+	return hashed
 }
 
 func getSecurityRuleName(service *v1.Service, port v1.ServicePort, sourceAddrPrefix string) string {
@@ -207,6 +251,67 @@ func getSecurityRuleName(service *v1.Service, port v1.ServicePort, sourceAddrPre
 	return fmt.Sprintf("%s-%s-%d-%s", getRulePrefix(service), port.Protocol, port.Port, safePrefix)
 }
 
+// sharedSecurityRulePrefix marks an allow rule named by protocol/port/source alone rather than
+// by a service's UID-based prefix (see getRulePrefix), so two services wanting the identical
+// rule share one NSG entry instead of each getting a near-duplicate.
+const sharedSecurityRulePrefix = "shared"
+
+// getSharedSecurityRuleName returns the service-independent name for the allow rule covering
+// port's protocol/number and sourceAddrPrefix.
+func getSharedSecurityRuleName(port v1.ServicePort, sourceAddrPrefix string) string {
+	safePrefix := strings.Replace(sourceAddrPrefix, "/", "_", -1)
+	return fmt.Sprintf("%s-%s-%d-%s", sharedSecurityRulePrefix, port.Protocol, port.Port, safePrefix)
+}
+
+func isSharedSecurityRuleName(name string) bool {
+	return strings.HasPrefix(name, sharedSecurityRulePrefix+"-")
+}
+
+// sharedSecurityRuleServiceSeparator joins the names of services currently needing a shared
+// rule in its Description field, which doubles as the rule's refcount.
+const sharedSecurityRuleServiceSeparator = ","
+
+func sharedSecurityRuleServices(rule network.SecurityRule) []string {
+	desc := to.String(rule.Description)
+	if desc == "" {
+		return nil
+	}
+	return strings.Split(desc, sharedSecurityRuleServiceSeparator)
+}
+
+func sharedSecurityRuleReferencesService(rule network.SecurityRule, serviceName string) bool {
+	for _, s := range sharedSecurityRuleServices(rule) {
+		if s == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// addServiceToSharedSecurityRule records serviceName as needing rule, growing its refcount.
+// A no-op if serviceName is already recorded.
+func addServiceToSharedSecurityRule(rule network.SecurityRule, serviceName string) network.SecurityRule {
+	if sharedSecurityRuleReferencesService(rule, serviceName) {
+		return rule
+	}
+	services := append(sharedSecurityRuleServices(rule), serviceName)
+	rule.Description = to.StringPtr(strings.Join(services, sharedSecurityRuleServiceSeparator))
+	return rule
+}
+
+// removeServiceFromSharedSecurityRule drops serviceName's reference to rule, returning the
+// updated rule and whether its refcount reached zero, meaning the rule should now be deleted.
+func removeServiceFromSharedSecurityRule(rule network.SecurityRule, serviceName string) (network.SecurityRule, bool) {
+	var remaining []string
+	for _, s := range sharedSecurityRuleServices(rule) {
+		if s != serviceName {
+			remaining = append(remaining, s)
+		}
+	}
+	rule.Description = to.StringPtr(strings.Join(remaining, sharedSecurityRuleServiceSeparator))
+	return rule, len(remaining) == 0
+}
+
 // This returns a human-readable version of the Service used to tag some resources.
 // This is only used for human-readable convenience, and not to filter.
 func getServiceName(service *v1.Service) string {
@@ -219,7 +324,7 @@ func getRulePrefix(service *v1.Service) string {
 }
 
 func getPublicIPName(clusterName string, service *v1.Service) string {
-	return fmt.Sprintf("%s-%s", clusterName, cloudprovider.GetLoadBalancerName(service))
+	return fmt.Sprintf("%s-%s", clusterName, frontendIPConfigKey(service))
 }
 
 func serviceOwnsRule(service *v1.Service, rule string) bool {
@@ -228,27 +333,54 @@ func serviceOwnsRule(service *v1.Service, rule string) bool {
 }
 
 func serviceOwnsFrontendIP(fip network.FrontendIPConfiguration, service *v1.Service) bool {
-	baseName := cloudprovider.GetLoadBalancerName(service)
+	baseName := frontendIPConfigKey(service)
 	return strings.HasPrefix(*fip.Name, baseName)
 }
 
+// frontendIPConfigNameMaxLength is Azure's resource name length limit, which a long subnet
+// name appended to the (already UID-bounded) load balancer base name can exceed.
+const frontendIPConfigNameMaxLength = 80
+
 func getFrontendIPConfigName(service *v1.Service, subnetName *string) string {
-	baseName := cloudprovider.GetLoadBalancerName(service)
-	if subnetName != nil {
-		return fmt.Sprintf("%s-%s", baseName, *subnetName)
+	baseName := frontendIPConfigKey(service)
+	if subnetName == nil {
+		return baseName
+	}
+	name := fmt.Sprintf("%s-%s", baseName, *subnetName)
+	if len(name) <= frontendIPConfigNameMaxLength {
+		return name
+	}
+	// The full name doesn't fit: fold the subnet name down to a short, stable hash instead of
+	// truncating it outright, so distinct long subnet names don't collide and the resulting
+	// name stays the same across reconciles.
+	hashed := fmt.Sprintf("%s-%s", baseName, MakeCRC32(*subnetName))
+	if len(hashed) > frontendIPConfigNameMaxLength {
+		hashed = hashed[:frontendIPConfigNameMaxLength]
 	}
-	return baseName
+	return hashed
 }
 
-// This returns the next available rule priority level for a given set of security rules.
-func getNextAvailablePriority(rules []network.SecurityRule) (int32, error) {
-	var smallest int32 = loadBalancerMinimumPriority
+// ErrNSGPriorityExhausted is wrapped into the error getNextAvailablePriority returns once an NSG
+// has no priority levels left in the loadBalancerMinimumPriority-loadBalancerMaximumPriority
+// range, so callers (e.g. reconcileSecurityGroup, or an upstream controller surfacing this to an
+// operator) can detect this specific, actionable condition with errors.Is rather than pattern
+// matching on the message text.
+var ErrNSGPriorityExhausted = errors.New("NSG priority range exhausted")
+
+// getNextAvailablePriority returns the next available rule priority level in [minPriority,
+// maxPriority) for a given set of security rules. minPriority/maxPriority let callers scope the
+// search to a reserved sub-range (e.g. azureLoadBalancerTagRulePriorityBase's band) instead of
+// the general per-service rule range, so two independent reconciles allocating within the same
+// reserved band still land on distinct priorities instead of both defaulting to the band's base.
+// rules without a Priority set yet are ignored rather than dereferenced.
+func getNextAvailablePriority(nsgName string, rules []network.SecurityRule, minPriority, maxPriority int32) (int32, error) {
+	var smallest = minPriority
 	var spread int32 = 1
 
 outer:
-	for smallest < loadBalancerMaximumPriority {
+	for smallest < maxPriority {
 		for _, rule := range rules {
-			if *rule.Priority == smallest {
+			if rule.Priority != nil && *rule.Priority == smallest {
 				smallest += spread
 				continue outer
 			}
@@ -257,7 +389,16 @@ outer:
 		return smallest, nil
 	}
 
-	return -1, fmt.Errorf("SecurityGroup priorities are exhausted")
+	return -1, fmt.Errorf("securityGroup %q priorities are exhausted: %d rules occupy the %d-%d range; consolidate rules (e.g. by widening source ranges) to free up priorities: %w", nsgName, len(rules), minPriority, maxPriority, ErrNSGPriorityExhausted)
+}
+
+func stringSliceContains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 func (az *Cloud) getIPForMachine(nodeName types.NodeName) (string, error) {
@@ -313,7 +454,7 @@ func splitProviderID(providerID string) (types.NodeName, error) {
 
 var polyTable = crc32.MakeTable(crc32.Koopman)
 
-//MakeCRC32 : convert string to CRC32 format
+// MakeCRC32 : convert string to CRC32 format
 func MakeCRC32(str string) string {
 	crc := crc32.New(polyTable)
 	crc.Write([]byte(str))
@@ -321,7 +462,7 @@ func MakeCRC32(str string) string {
 	return strconv.FormatUint(uint64(hash), 10)
 }
 
-//ExtractVMData : extract dataDisks, storageProfile from a map struct
+// ExtractVMData : extract dataDisks, storageProfile from a map struct
 func ExtractVMData(vmData map[string]interface{}) (dataDisks []interface{},
 	storageProfile map[string]interface{},
 	hardwareProfile map[string]interface{}, err error) {
@@ -347,7 +488,7 @@ func ExtractVMData(vmData map[string]interface{}) (dataDisks []interface{},
 	return dataDisks, storageProfile, hardwareProfile, nil
 }
 
-//ExtractDiskData : extract provisioningState, diskState from a map struct
+// ExtractDiskData : extract provisioningState, diskState from a map struct
 func ExtractDiskData(diskData interface{}) (provisioningState string, diskState string, err error) {
 	fragment, ok := diskData.(map[string]interface{})
 	if !ok {
@@ -17,15 +17,32 @@ limitations under the License.
 package azure
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
+// wrapAzureError annotates a non-nil error from an Azure client call with the operation,
+// resource group, and resource name that produced it, so a raw autorest.DetailedError like "Not
+// Found" doesn't leave a multi-tenant cluster's operator guessing which resource group or
+// service it came from. It wraps with %w rather than discarding err, so errors.As can still
+// recover the original error - checkResourceExistsFromError relies on this to keep doing its
+// StatusCode-based branching on the underlying autorest.DetailedError.
+func wrapAzureError(operation, resourceGroup, resourceName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s(resourceGroup=%s, resource=%s): %w", operation, resourceGroup, resourceName, err)
+}
+
 // checkExistsFromError inspects an error and returns a true if err is nil,
 // false if error is an autorest.Error with StatusCode=404 and will return the
 // error back if error is another status code or another type of error.
@@ -33,21 +50,76 @@ func checkResourceExistsFromError(err error) (bool, error) {
 	if err == nil {
 		return true, nil
 	}
-	v, ok := err.(autorest.DetailedError)
-	if ok && v.StatusCode == http.StatusNotFound {
+	var v autorest.DetailedError
+	if errors.As(err, &v) && v.StatusCode == http.StatusNotFound {
 		return false, nil
 	}
-	return false, v
+	return false, err
+}
+
+// ignoreNotFoundError treats a 404 from an Azure delete call as success, so tearing down a
+// resource that's already gone - e.g. a service deleted twice, or an LB/PIP removed by a prior,
+// interrupted cleanup - is a no-op rather than an error, matching what the Kubernetes service
+// controller expects of EnsureLoadBalancerDeleted. Any other error still propagates unchanged.
+// This provider has no subnet-delete call of its own (subnets belong to whoever owns the vnet,
+// not to load balancer teardown), so there's nothing to apply it to there.
+func ignoreNotFoundError(err error) error {
+	_, realErr := checkResourceExistsFromError(err)
+	return realErr
+}
+
+// runBounded runs funcs concurrently, at most maxConcurrency at a time, and aggregates all
+// non-nil errors rather than aborting on the first one - so one failing NIC update doesn't stop
+// the rest of a large node pool from being reconciled. maxConcurrency <= 0 is treated as
+// unbounded, matching utilerrors.AggregateGoroutines' behavior for an empty pool size.
+func runBounded(maxConcurrency int, funcs ...func() error) utilerrors.Aggregate {
+	if maxConcurrency <= 0 || maxConcurrency >= len(funcs) {
+		return utilerrors.AggregateGoroutines(funcs...)
+	}
+
+	errChan := make(chan error, len(funcs))
+	sem := make(chan struct{}, maxConcurrency)
+	for _, f := range funcs {
+		sem <- struct{}{}
+		go func(f func() error) {
+			defer func() { <-sem }()
+			errChan <- f()
+		}(f)
+	}
+
+	errs := make([]error, 0)
+	for i := 0; i < len(funcs); i++ {
+		if err := <-errChan; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
+// vmCacheKey returns the vmCache key for a VM in resourceGroup named vmName.
+func vmCacheKey(resourceGroup, vmName string) string {
+	return resourceGroup + "/" + vmName
+}
+
+// getVirtualMachine's uncached path calls VirtualMachinesClient.Get directly against ARM.
+// There's no fakeVirtualMachinesClient in this vendored tree - like every other Azure client
+// here, compute.VirtualMachinesClient is a concrete generated SDK struct rather than an
+// interface - so tests either seed vmCache with a found VM or point the real client at an
+// httptest server (e.g. one that answers 404 for a VM that is gone).
 func (az *Cloud) getVirtualMachine(nodeName types.NodeName) (vm compute.VirtualMachine, exists bool, err error) {
+	vmName := string(nodeName)
+	key := vmCacheKey(az.ResourceGroup, vmName)
+	if cached, found := az.vmCache.Get(key); found {
+		return cached.(compute.VirtualMachine), true, nil
+	}
+
 	var realErr error
 
-	vmName := string(nodeName)
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("VirtualMachinesClient.Get(%s): start", vmName)
 	vm, err = az.VirtualMachinesClient.Get(az.ResourceGroup, vmName, "")
 	glog.V(10).Infof("VirtualMachinesClient.Get(%s): end", vmName)
+	err = wrapAzureError("VirtualMachinesClient.Get", az.ResourceGroup, vmName, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
@@ -58,16 +130,26 @@ func (az *Cloud) getVirtualMachine(nodeName types.NodeName) (vm compute.VirtualM
 		return vm, false, nil
 	}
 
+	az.vmCache.Add(key, vm, time.Duration(az.VMCacheTTLInSeconds)*time.Second)
 	return vm, exists, err
 }
 
+// InvalidateCachedVirtualMachine removes node's VM from the cache populated by
+// getVirtualMachine, if present, so the next lookup fetches a fresh copy instead of
+// potentially-stale cached data. Callers that know a node's VM changed through some path other
+// than CreateOrUpdateVMWithRetry (which already invalidates automatically) should call this.
+func (az *Cloud) InvalidateCachedVirtualMachine(nodeName types.NodeName) {
+	az.vmCache.Remove(vmCacheKey(az.ResourceGroup, string(nodeName)))
+}
+
 func (az *Cloud) getRouteTable() (routeTable network.RouteTable, exists bool, err error) {
 	var realErr error
 
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("RouteTablesClient.Get(%s): start", az.RouteTableName)
-	routeTable, err = az.RouteTablesClient.Get(az.ResourceGroup, az.RouteTableName, "")
+	routeTable, err = az.RouteTablesClient.Get(az.routeTableResourceGroup(), az.RouteTableName, "")
 	glog.V(10).Infof("RouteTablesClient.Get(%s): end", az.RouteTableName)
+	err = wrapAzureError("RouteTablesClient.Get", az.routeTableResourceGroup(), az.RouteTableName, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
@@ -81,13 +163,33 @@ func (az *Cloud) getRouteTable() (routeTable network.RouteTable, exists bool, er
 	return routeTable, exists, err
 }
 
+// nsgCacheKey returns the nsgCache key for the NSG named nsgName in resourceGroup.
+func nsgCacheKey(resourceGroup, nsgName string) string {
+	return resourceGroup + "/" + nsgName
+}
+
+// getSecurityGroup is cached for nsgCacheTTLInSeconds so that a burst of service reconciles in
+// quick succession - each wanting to read-modify-write the one shared NSG - share a single read
+// instead of each re-fetching it. The cache is busted immediately by InvalidateCachedSecurityGroup
+// whenever this provider writes the NSG, so readers never see their own writes go stale. The
+// copy stored in nsgCache and every copy returned from it go through cloneSecurityGroup: network.SecurityGroup embeds its properties (and
+// SecurityRules) by pointer, and reconcileSecurityGroup mutates those in place while computing
+// the desired state, before CreateOrUpdate is even attempted - without cloning, a denied or
+// failed write would leave the cache holding that half-applied mutation instead of the real,
+// last-known-good NSG.
 func (az *Cloud) getSecurityGroup() (sg network.SecurityGroup, exists bool, err error) {
+	key := nsgCacheKey(az.ResourceGroup, az.SecurityGroupName)
+	if cached, found := az.nsgCache.Get(key); found {
+		return cloneSecurityGroup(cached.(network.SecurityGroup)), true, nil
+	}
+
 	var realErr error
 
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("SecurityGroupsClient.Get(%s): start", az.SecurityGroupName)
 	sg, err = az.SecurityGroupsClient.Get(az.ResourceGroup, az.SecurityGroupName, "")
 	glog.V(10).Infof("SecurityGroupsClient.Get(%s): end", az.SecurityGroupName)
+	err = wrapAzureError("SecurityGroupsClient.Get", az.ResourceGroup, az.SecurityGroupName, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
@@ -98,9 +200,18 @@ func (az *Cloud) getSecurityGroup() (sg network.SecurityGroup, exists bool, err
 		return sg, false, nil
 	}
 
+	az.nsgCache.Add(key, cloneSecurityGroup(sg), nsgCacheTTLInSeconds*time.Second)
 	return sg, exists, err
 }
 
+// InvalidateCachedSecurityGroup removes the NSG from the cache populated by getSecurityGroup, if
+// present, so the next lookup fetches a fresh copy instead of potentially-stale cached data.
+// Callers that write the NSG via SecurityGroupsClient.CreateOrUpdate must call this immediately
+// afterwards.
+func (az *Cloud) InvalidateCachedSecurityGroup() {
+	az.nsgCache.Remove(nsgCacheKey(az.ResourceGroup, az.SecurityGroupName))
+}
+
 func (az *Cloud) getAzureLoadBalancer(name string) (lb network.LoadBalancer, exists bool, err error) {
 	var realErr error
 
@@ -108,6 +219,7 @@ func (az *Cloud) getAzureLoadBalancer(name string) (lb network.LoadBalancer, exi
 	glog.V(10).Infof("LoadBalancerClient.Get(%s): start", name)
 	lb, err = az.LoadBalancerClient.Get(az.ResourceGroup, name, "")
 	glog.V(10).Infof("LoadBalancerClient.Get(%s): end", name)
+	err = wrapAzureError("LoadBalancerClient.Get", az.ResourceGroup, name, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
@@ -121,13 +233,47 @@ func (az *Cloud) getAzureLoadBalancer(name string) (lb network.LoadBalancer, exi
 	return lb, exists, err
 }
 
-func (az *Cloud) getPublicIPAddress(name string) (pip network.PublicIPAddress, exists bool, err error) {
+// ListManagedLoadBalancers returns every LoadBalancer in az.ResourceGroup that this cluster owns
+// by name - i.e. named getLoadBalancerName(clusterName, false) or getLoadBalancerName(clusterName,
+// true) - for cleanup tooling that needs to enumerate what it manages without touching a LB some
+// other cluster happens to share the resource group with.
+func (az *Cloud) ListManagedLoadBalancers(clusterName string) ([]network.LoadBalancer, error) {
+	az.operationPollRateLimiter.Accept()
+	glog.V(10).Infof("LoadBalancerClient.List(%s): start", az.ResourceGroup)
+	list, err := az.LoadBalancerClient.List(az.ResourceGroup)
+	glog.V(10).Infof("LoadBalancerClient.List(%s): end", az.ResourceGroup)
+	err = wrapAzureError("LoadBalancerClient.List", az.ResourceGroup, "", err)
+	if err != nil {
+		return nil, err
+	}
+
+	externalName := getLoadBalancerName(clusterName, false)
+	internalName := getLoadBalancerName(clusterName, true)
+
+	var managed []network.LoadBalancer
+	if list.Value != nil {
+		for ix := range *list.Value {
+			lb := (*list.Value)[ix]
+			if lb.Name == nil {
+				continue
+			}
+			if *lb.Name == externalName || *lb.Name == internalName {
+				managed = append(managed, lb)
+			}
+		}
+	}
+	return managed, nil
+}
+
+func (az *Cloud) getPublicIPAddress(pipResourceGroup string, name string) (pip network.PublicIPAddress, exists bool, err error) {
 	var realErr error
+	rg := az.pipResourceGroup(pipResourceGroup)
 
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("PublicIPAddressesClient.Get(%s): start", name)
-	pip, err = az.PublicIPAddressesClient.Get(az.ResourceGroup, name, "")
+	pip, err = az.PublicIPAddressesClient.Get(rg, name, "")
 	glog.V(10).Infof("PublicIPAddressesClient.Get(%s): end", name)
+	err = wrapAzureError("PublicIPAddressesClient.Get", rg, name, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
@@ -141,20 +287,78 @@ func (az *Cloud) getPublicIPAddress(name string) (pip network.PublicIPAddress, e
 	return pip, exists, err
 }
 
-func (az *Cloud) getSubnet(virtualNetworkName string, subnetName string) (subnet network.Subnet, exists bool, err error) {
-	var realErr error
-	var rg string
+// pipResourceGroup resolves the resource group a public IP lookup/write should use: a
+// per-service override (e.g. from ServiceAnnotationLoadBalancerPIPResourceGroup) takes
+// precedence over the cluster-wide PipResourceGroup default, which itself falls back to the
+// cluster's own ResourceGroup, letting PIPs be centralized in a shared group while the load
+// balancer itself stays in the cluster's group.
+func (az *Cloud) pipResourceGroup(override string) string {
+	if len(override) > 0 {
+		return override
+	}
+	if len(az.PipResourceGroup) > 0 {
+		return az.PipResourceGroup
+	}
+	return az.ResourceGroup
+}
 
+// vnetResourceGroupForSubnet resolves the resource group a subnet lookup should use: a
+// per-service override (e.g. from ServiceAnnotationLoadBalancerInternalSubnetResourceGroup)
+// takes precedence over the cluster-wide VnetResourceGroup, which itself falls back to the
+// cluster's own ResourceGroup when the vnet lives alongside the cluster.
+func (az *Cloud) vnetResourceGroupForSubnet(override string) string {
+	if len(override) > 0 {
+		return override
+	}
 	if len(az.VnetResourceGroup) > 0 {
-		rg = az.VnetResourceGroup
-	} else {
-		rg = az.ResourceGroup
+		return az.VnetResourceGroup
 	}
+	return az.ResourceGroup
+}
+
+// routeTableResourceGroup resolves the resource group the cluster's route table lives in: route
+// tables are attached to the cluster's vnet, so they fall back to VnetResourceGroup before
+// falling back to the cluster's own ResourceGroup when the vnet lives alongside the cluster.
+func (az *Cloud) routeTableResourceGroup() string {
+	if len(az.VnetResourceGroup) > 0 {
+		return az.VnetResourceGroup
+	}
+	return az.ResourceGroup
+}
+
+func (az *Cloud) getSubnet(virtualNetworkName string, subnetName string, vnetResourceGroup string) (subnet network.Subnet, exists bool, err error) {
+	return az.getSubnetCrossSubscription(virtualNetworkName, subnetName, vnetResourceGroup, "")
+}
+
+// subnetsClientForSubscription returns the SubnetsClient to use for a subnet lookup: az.SubnetsClient
+// itself when subscriptionID is empty or already matches the cluster's own, or - for a vnet that
+// lives in a separate shared-networking subscription entirely (see
+// ServiceAnnotationLoadBalancerInternalSubnetSubscriptionID) - a client freshly pointed at that
+// subscription, reusing az.SubnetsClient's authorizer and base URI. ARM scopes a client's requests
+// to the subscription baked into its own base path, so the cluster's own SubnetsClient can't be
+// reused as-is to reach a subnet owned by a different subscription.
+func (az *Cloud) subnetsClientForSubscription(subscriptionID string) network.SubnetsClient {
+	if subscriptionID == "" || subscriptionID == az.SubscriptionID {
+		return az.SubnetsClient
+	}
+	client := network.NewSubnetsClientWithBaseURI(az.SubnetsClient.BaseURI, subscriptionID)
+	client.Authorizer = az.SubnetsClient.Authorizer
+	return client
+}
+
+// getSubnetCrossSubscription is getSubnet's cross-subscription form: vnetSubscriptionID selects
+// which subscription's SubnetsClient serves the lookup (see subnetsClientForSubscription), empty
+// meaning the cluster's own.
+func (az *Cloud) getSubnetCrossSubscription(virtualNetworkName string, subnetName string, vnetResourceGroup string, vnetSubscriptionID string) (subnet network.Subnet, exists bool, err error) {
+	var realErr error
+	rg := az.vnetResourceGroupForSubnet(vnetResourceGroup)
+	client := az.subnetsClientForSubscription(vnetSubscriptionID)
 
 	az.operationPollRateLimiter.Accept()
 	glog.V(10).Infof("SubnetsClient.Get(%s): start", subnetName)
-	subnet, err = az.SubnetsClient.Get(rg, virtualNetworkName, subnetName, "")
+	subnet, err = client.Get(rg, virtualNetworkName, subnetName, "")
 	glog.V(10).Infof("SubnetsClient.Get(%s): end", subnetName)
+	err = wrapAzureError("SubnetsClient.Get", rg, subnetName, err)
 
 	exists, realErr = checkResourceExistsFromError(err)
 	if realErr != nil {
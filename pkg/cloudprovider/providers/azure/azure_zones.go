@@ -18,6 +18,7 @@ package azure
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -30,7 +31,8 @@ import (
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 )
 
-const instanceInfoURL = "http://169.254.169.254/metadata/v1/InstanceInfo"
+// instanceInfoURL is a var, not a const, so tests can point it at a fake metadata server.
+var instanceInfoURL = "http://169.254.169.254/metadata/v1/InstanceInfo"
 
 var faultMutex = &sync.Mutex{}
 var faultDomain *string
@@ -81,13 +83,19 @@ func (az *Cloud) GetZoneByNodeName(nodeName types.NodeName) (cloudprovider.Zone,
 		return cloudprovider.Zone{}, err
 	}
 
-	failureDomain := strconv.Itoa(int(*vm.VirtualMachineProperties.InstanceView.PlatformFaultDomain))
+	return zoneFromVirtualMachine(vm), nil
+}
 
-	zone := cloudprovider.Zone{
+// zoneFromVirtualMachine derives a node's failure zone from its VirtualMachine object. An
+// Availability Zone, when the VM reports one, is more authoritative than a fault domain, but
+// this vendored Azure SDK doesn't model Availability Zones on compute.VirtualMachine, so this
+// always falls back to the VM's platform fault domain.
+func zoneFromVirtualMachine(vm compute.VirtualMachine) cloudprovider.Zone {
+	failureDomain := strconv.Itoa(int(*vm.VirtualMachineProperties.InstanceView.PlatformFaultDomain))
+	return cloudprovider.Zone{
 		FailureDomain: failureDomain,
 		Region:        *(vm.Location),
 	}
-	return zone, nil
 }
 
 func fetchFaultDomain() (*string, error) {
@@ -109,5 +117,8 @@ func readFaultDomain(reader io.Reader) (*string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if instanceInfo.FaultDomain == "" {
+		return nil, fmt.Errorf("instance metadata returned an empty fault domain")
+	}
 	return &instanceInfo.FaultDomain, nil
 }